@@ -3,9 +3,10 @@ package exporter_onlch
 import (
 	"context"
 	_ "embed"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"math"
 	"os"
 	"path/filepath"
@@ -13,7 +14,6 @@ import (
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 
-	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/algorand/conduit/conduit/data"
 	"github.com/algorand/conduit/conduit/plugins"
 	"github.com/algorand/conduit/conduit/plugins/exporters"
@@ -26,7 +26,7 @@ var sampleConfig string
 // metadata contains information about the plugin used for CLI helpers.
 var metadata = plugins.Metadata{
 	Name:         "online_clickhouse",
-	Description:  "Exports participation account state aggregates to ClickHouse.",
+	Description:  "Exports participation account state aggregates to ClickHouse, PostgreSQL or SQLite.",
 	Deprecated:   false,
 	SampleConfig: sampleConfig,
 }
@@ -39,12 +39,29 @@ func init() {
 
 // onlineExporter is the object which implements the exporter plugin interface.
 type onlineExporter struct {
-	log     *logrus.Logger
-	cfg     Config
-	ctx     context.Context
-	onls    *onlineStakeState
-	batcher *AggregateBundle
-	chdb    clickhouse.Conn
+	log         *logrus.Logger
+	cfg         Config
+	ctx         context.Context
+	onls        *onlineStakeState
+	genesisHash types.Digest
+	batcher     *AggregateBundle
+	catchup     *CatchupMonitor
+	drift       *DriftMonitor
+	sinks       []Sink
+	spool       *exportSpool
+	writer      *exportWriter
+	keyregs     []keyregRecord
+	resumed     bool
+}
+
+// keyregRecord holds key registration (inner)transaction details for the keyreg history table
+type keyregRecord struct {
+	round  types.Round
+	sender types.Address
+	auth   types.Address
+	appID  types.AppIndex
+	fee    types.MicroAlgos
+	kr     types.KeyregTxnFields
 }
 
 func (oe *onlineExporter) Metadata() plugins.Metadata {
@@ -58,72 +75,188 @@ func (oe *onlineExporter) Config() string {
 
 func (oe *onlineExporter) Close() error {
 	oe.log.Infof("Shutting down")
-	oe.batcher.SmartFlush()
-	return nil
+	if err := oe.batcher.Flush(); err != nil {
+		return err
+	}
+	if oe.writer != nil {
+		if err := oe.writer.Close(); err != nil {
+			return err
+		}
+		oe.writer = nil
+	}
+	if err := oe.replaySpool(true); err != nil {
+		return err
+	}
+	return oe.closeSinks()
 }
 
 // persistOnlineStakeState persists current online state in JSON file
+// the file is written by the export writer after all bins exported so far
 func (oe *onlineExporter) persistOnlineStakeState() error {
 	if oe.isDebugRun() {
 		return nil
 	}
+	fName := filepath.Join(oe.cfg.datadir, oe.cfg.StateFile)
+	job, err := oe.stateJob(fName)
+	if err != nil {
+		return err
+	}
+	return oe.batcher.Defer(job)
+}
+
+// stateJob snapshots current online state into a writer job writing fName
+func (oe *onlineExporter) stateJob(fName string) (*writerJob, error) {
 	jPayload, err := json.MarshalIndent(oe.onls, "", " ")
 	if err != nil {
+		return nil, err
+	}
+	round, gh := oe.onls.UpdatedAtRnd, oe.genesisHash
+	return &writerJob{
+		key: fName,
+		persist: func() error {
+			return writeStateFile(fName, round, gh, jPayload)
+		},
+	}, nil
+}
+
+// discardOnlineStakeState moves state file aside once queued exports and state updates are written
+// the pipeline has to be reset to round 0 to rebuild the state from genesis
+func (oe *onlineExporter) discardOnlineStakeState() error {
+	if oe.isDebugRun() {
+		return nil
+	}
+	if err := oe.batcher.Flush(); err != nil {
 		return err
 	}
+	if oe.writer != nil {
+		if err := oe.writer.Close(); err != nil {
+			return err
+		}
+		oe.writer = nil
+	}
 	fName := filepath.Join(oe.cfg.datadir, oe.cfg.StateFile)
-	err = os.WriteFile(fName, jPayload, 0644)
-	return err
+	if err := os.Rename(fName, fName+".drift"); err != nil {
+		return err
+	}
+	oe.log.Errorf("State moved to %s.drift, reset pipeline to round 0 to rebuild", fName)
+	return nil
 }
 
-// loadOnlineStakeState loads persisted state from JSON file or Genesis if starting from round 0
-func (oe *onlineExporter) loadOnlineStakeState(ip data.InitProvider) (*onlineStakeState, error) {
-	oe.log.Infof("Loading stake at round %d", ip.NextDBRound())
-	onls := &onlineStakeState{
+// newOnlineStakeState returns empty online state
+func (oe *onlineExporter) newOnlineStakeState(ip data.InitProvider) *onlineStakeState {
+	return &onlineStakeState{
 		Accounts:     make(map[types.Address]*partAccount),
 		TotalStake:   0,
 		UpdatedAtRnd: 0,
 		NextExpiry:   math.MaxInt64,
+		Unmarked:     make(map[string]types.Round),
 		dirty:        true,
 		log:          oe.log,
 		ip:           ip,
+		overrides:    oe.cfg.Consensus,
+		fallback:     networkPresets[oe.cfg.Network].consensus,
+	}
+}
+
+// readOnlineStakeState reads and verifies persisted state from fName
+func (oe *onlineExporter) readOnlineStakeState(fName string, onls *onlineStakeState) error {
+	content, round, err := readStateFile(fName, oe.genesisHash)
+	if errors.Is(err, errLegacyState) {
+		oe.log.Warnf("Loading unverified state file %s without header", fName)
+	} else if err != nil {
+		oe.log.Errorf("Error reading file: %v", err)
+		return err
+	}
+	err = json.Unmarshal(content, onls)
+	if err != nil {
+		oe.log.Errorf("Error reading state: %v", err)
+		return err
 	}
+	if round != 0 && round != onls.UpdatedAtRnd {
+		err := fmt.Errorf("state file round %d does not match state round %d", round, onls.UpdatedAtRnd)
+		oe.log.Errorf("Error reading state: %v", err)
+		return err
+	}
+	if onls.Unmarked == nil {
+		onls.Unmarked = make(map[string]types.Round)
+	}
+	// states saved before protocol tracking start from the genesis protocol
+	if onls.Protocol == "" {
+		onls.Protocol = onls.ip.GetGenesis().Proto
+	}
+	if err := oe.checkStateGenesis(onls); err != nil {
+		oe.log.Errorf("Error reading state: %v", err)
+		return err
+	}
+	onls.setProtocol(onls.UpdatedAtRnd, onls.Protocol)
+	return nil
+}
+
+// loadOnlineStakeState loads persisted state from JSON file or Genesis if starting from round 0
+// rewinds to a checkpoint if the pipeline round went backwards
+func (oe *onlineExporter) loadOnlineStakeState(ip data.InitProvider) (*onlineStakeState, error) {
+	oe.log.Infof("Loading stake at round %d", ip.NextDBRound())
+	onls := oe.newOnlineStakeState(ip)
 	if ip.NextDBRound() == 0 || oe.isDebugRun() {
+		onls.GenesisID = ip.GetGenesis().ID()
+		onls.GenesisHash = base64.StdEncoding.EncodeToString(oe.genesisHash[:])
+		onls.setProtocol(0, ip.GetGenesis().Proto)
 		onls.loadFromGenesis()
 		onls.updateTotals(0)
-		// TODO: Genesis state is invalid (empty) for the first 320 rounds
 		return onls, nil
 	}
-	//BUG: refuse to sync where NextDBRound > Clickhouse batch
-
 	fName := filepath.Join(oe.cfg.datadir, oe.cfg.StateFile)
-	file, err := os.Open(fName)
-	if err != nil {
-		oe.log.Errorf("Error opening file: %v", err)
-		return nil, err
+	if _, err := os.Stat(fName); errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(fName + ".drift"); err == nil {
+			err := fmt.Errorf("state moved to %s.drift by drift-policy rebuild, reset pipeline to round 0 to rebuild", fName)
+			oe.log.Errorf("Error reading state: %v", err)
+			return nil, err
+		}
 	}
-	defer file.Close()
-	content, err := io.ReadAll(file)
-	if err != nil {
-		oe.log.Errorf("Error reading file: %v", err)
+	if err := oe.readOnlineStakeState(fName, onls); err != nil {
 		return nil, err
 	}
-	err = json.Unmarshal(content, onls)
-	if err != nil {
+
+	// rounds processed after the saved state were lost, the pipeline has to resume right after it
+	// legacy states without processed round are not checked
+	if (onls.ProcessedRnd > 0 || onls.UpdatedAtRnd == 0) && ip.NextDBRound() > onls.ProcessedRnd+1 {
+		err := fmt.Errorf("state saved at round %d with last exported bin %d, pipeline has to resume at round %d instead of %d", onls.ProcessedRnd, onls.SentBinRnd, onls.ProcessedRnd+1, ip.NextDBRound())
 		oe.log.Errorf("Error reading state: %v", err)
 		return nil, err
 	}
 
-	if ip.NextDBRound() < onls.UpdatedAtRnd {
-		err := fmt.Errorf("state round %d after nextDBRound", onls.UpdatedAtRnd)
-		oe.log.Errorf("Error reading state: %v", err)
-		return nil, err
+	// pipeline went backwards, the last processed round may be replayed after a crash
+	behind := oe.cfg.Checkpoints > 0 && ip.NextDBRound() <= onls.ProcessedRnd
+	if ip.NextDBRound() < onls.UpdatedAtRnd || behind {
+		if oe.cfg.Checkpoints <= 0 {
+			err := fmt.Errorf("state round %d after nextDBRound", onls.UpdatedAtRnd)
+			oe.log.Errorf("Error reading state: %v", err)
+			return nil, err
+		}
+		cRnd, err := oe.findCheckpoint(ip.NextDBRound())
+		if err != nil {
+			oe.log.Errorf("Error rewinding state: %v", err)
+			return nil, err
+		}
+		oe.log.Warnf("Rewinding state from round %d to checkpoint at round %d", onls.ProcessedRnd, cRnd)
+		onls = oe.newOnlineStakeState(ip)
+		if err := oe.readOnlineStakeState(oe.checkpointName(cRnd), onls); err != nil {
+			return nil, err
+		}
 	}
-	onls.updateTotals(ip.NextDBRound())
+	// pipeline resumes right after the saved state or checkpoint, rows exported after it are processed again
+	oe.resumed = onls.ProcessedRnd > 0 && ip.NextDBRound() == onls.ProcessedRnd+1
+
+	onls.restore()
 
 	return onls, nil
 }
 
+// isFullSnapshotRound returns true if all voting accounts should be exported in the snapshot of round
+func (oe *onlineExporter) isFullSnapshotRound(round types.Round) bool {
+	return oe.cfg.SnapshotFull > 0 && int64(round)%oe.cfg.SnapshotFull == 0
+}
+
 func (oe *onlineExporter) isDebugRun() bool {
 	return oe.cfg.Debug != ""
 }
@@ -135,15 +268,56 @@ func (oe *onlineExporter) Init(ctx context.Context, ip data.InitProvider, cfg pl
 	if err := cfg.UnmarshalConfig(&oe.cfg); err != nil {
 		return fmt.Errorf("unable to read configuration: %w", err)
 	}
-
-	if err = oe.chdbInit(); err != nil {
+	if err = oe.applyNetwork(); err != nil {
 		return err
 	}
+
+	// sink files are relative to the data directory
 	oe.cfg.datadir = cfg.DataDir
+	if oe.sinks, err = oe.MakeSinks(); err != nil {
+		return err
+	}
+	if oe.cfg.SpoolFile != "" {
+		if oe.spool, err = oe.MakeSpool(filepath.Join(oe.cfg.datadir, oe.cfg.SpoolFile)); err != nil {
+			return err
+		}
+	}
+	if oe.cfg.ExportQueue <= 0 {
+		oe.cfg.ExportQueue = 64
+	}
+	if oe.cfg.ChAggBatchBins <= 0 {
+		oe.cfg.ChAggBatchBins = 100
+	}
+	// aggregates, tiers and checkpoints are aligned on aggregate bins
+	if oe.cfg.ChAggBin <= 0 {
+		return fmt.Errorf("aggregate-bin must be set to a positive number of rounds")
+	}
+	if oe.cfg.CheckpointInterval <= 0 {
+		oe.cfg.CheckpointInterval = oe.cfg.ChAggBin
+	}
+	if err = oe.validateTiers(); err != nil {
+		return err
+	}
+	oe.genesisHash = ip.GetGenesis().Hash()
+	if err = oe.checkNetwork(ip.GetGenesis()); err != nil {
+		return err
+	}
 	oe.onls, err = oe.loadOnlineStakeState(ip)
+	if err != nil {
+		return err
+	}
 	oe.onls.aggBinSize = oe.cfg.ChAggBin
+	oe.onls.setTiers(oe.tierSpecs())
+	if ip.NextDBRound() > 0 {
+		// transitions seen while loading were exported before the restart
+		oe.onls.events = nil
+	}
+	oe.onls.legacyRewards = oe.cfg.LegacyRewards
 	oe.batcher = oe.MakeBatcher()
-	if err != nil {
+	if oe.drift, err = oe.MakeDriftMonitor(); err != nil {
+		return err
+	}
+	if oe.catchup, err = oe.MakeCatchupMonitor(); err != nil {
 		return err
 	}
 	if oe.isDebugRun() {
@@ -153,42 +327,137 @@ func (oe *onlineExporter) Init(ctx context.Context, ip data.InitProvider, cfg pl
 		oe.onls.debugAddr = &oe.cfg.debugAddr
 		oe.log.Error("debug run")
 	}
+	if err = oe.reconcile(ip.NextDBRound()); err != nil {
+		return err
+	}
+	if err = oe.setTierTTL(); err != nil {
+		return err
+	}
+	if ip.NextDBRound() == 0 {
+		// genesis accounts are online from round 0
+		for i := range oe.onls.events {
+			oe.onls.events[i].Round = 0
+			oe.onls.events[i].Reason = "genesis"
+		}
+		if err = oe.exportEvents(); err != nil {
+			return err
+		}
+		if err = oe.exportSnapshot(0, 0, true); err != nil {
+			return err
+		}
+		if err = oe.exportGenesisBins(); err != nil {
+			return err
+		}
+	}
 	if err = oe.persistOnlineStakeState(); err != nil {
 		return err
 	}
+	if err = oe.batcher.Flush(); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+// exportGenesisBins exports aggregates and totals for the first stake lag rounds
+// sortition uses genesis balances until the lag shifted state reaches round 0
+func (oe *onlineExporter) exportGenesisBins() error {
+	ts := oe.onls.ip.GetGenesis().Timestamp
+	lag := types.Round(oe.onls.lag())
+	for rnd := types.Round(0); rnd < lag; rnd++ {
+		full := oe.onls.updateTiers(uint64(rnd), rnd, 0)
+		// last genesis bin may be partial if aggregate-bin does not divide the stake lag
+		if oe.onls.updateAggregate(rnd) || rnd == lag-1 {
+			binRnd := uint64(rnd) - uint64(rnd)%uint64(oe.onls.aggBinSize)
+			if err := oe.exportAggregate(binRnd, ts); err != nil {
+				return err
+			}
+			if err := oe.exportTotal(binRnd, ts); err != nil {
+				return err
+			}
+			oe.onls.resetAggregate(rnd)
+		}
+		// tier bins continue after genesis rounds
+		if err := oe.exportTiers(full, uint64(rnd), rnd, ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // ProcessTX_DFS does depth first search on the (inner)transaction tree for account registrations
-func (oe *onlineExporter) ProcessTX_DFS(round types.Round, tx *types.SignedTxnWithAD) {
+// appID is the application issuing inner transactions or 0 for top level transactions
+func (oe *onlineExporter) ProcessTX_DFS(round types.Round, tx *types.SignedTxnWithAD, appID types.AppIndex) {
 	switch tx.Txn.Type {
 	case types.KeyRegistrationTx:
 		oe.onls.updateAccountWithKeyreg(round, tx)
+		if oe.cfg.KeyregTab != "" {
+			oe.keyregs = append(oe.keyregs, keyregRecord{
+				round:  round,
+				sender: tx.Txn.Sender,
+				auth:   tx.AuthAddr,
+				appID:  appID,
+				fee:    tx.Txn.Fee,
+				kr:     tx.Txn.KeyregTxnFields,
+			})
+		}
+	}
+	if len(tx.EvalDelta.InnerTxns) == 0 {
+		return
+	}
+	innerAppID := tx.Txn.ApplicationID
+	if innerAppID == 0 {
+		// inner transactions issued by a newly created application
+		innerAppID = types.AppIndex(tx.ApplyData.ApplicationID)
 	}
 	for j := range tx.EvalDelta.InnerTxns {
-		oe.ProcessTX_DFS(round, &tx.EvalDelta.InnerTxns[j])
+		oe.ProcessTX_DFS(round, &tx.EvalDelta.InnerTxns[j], innerAppID)
 	}
 }
 
 func (oe *onlineExporter) Receive(exportData data.BlockData) error {
+	// halted before the block changes any state, conduit retries the same block
+	if err := oe.drift.Err(); err != nil {
+		return err
+	}
 	round := exportData.BlockHeader.Round
-	oe.onls.rewardsLevel = exportData.BlockHeader.RewardsLevel
+	oe.onls.ProcessedRnd = round
+	oe.onls.updateRewardsLevel(exportData.BlockHeader.RewardsLevel)
+	oe.onls.updateProtocol(round, &exportData.BlockHeader)
+
+	isCatchup := oe.catchup.Monitor(round, exportData.BlockHeader.TimeStamp)
+	oe.batcher.isCatchup = isCatchup
+	oe.log.Infof("Processing block %d, catching-up:%t, %s", round, isCatchup, oe.catchup.Status())
+
+	// started on the first block as plugin metrics are registered after Init
+	if oe.writer == nil {
+		oe.writer = oe.MakeWriter(oe.cfg.ExportQueue)
+	}
+	if err := oe.writer.Err(); err != nil {
+		return err
+	}
+
+	// wall clock bins close before the first round of the next period
+	if err := oe.exportPeriods(round, exportData.BlockHeader.TimeStamp); err != nil {
+		return err
+	}
 
-	isCatchup := oe.batcher.Monitor(uint64(round))
-	oe.log.Infof("Processing block %d, catching-up:%t ", round, isCatchup)
+	oe.onls.updateProposer(round, exportData.BlockHeader.Proposer, exportData.BlockHeader.ProposerPayout, exportData.BlockHeader.FeesCollected)
 
 	ps := exportData.Payset
 	//Look for keyregs
 	for i := range ps {
-		oe.ProcessTX_DFS(round, &ps[i].SignedTxnWithAD)
+		oe.ProcessTX_DFS(round, &ps[i].SignedTxnWithAD, 0)
+	}
+	if err := oe.exportKeyregs(); err != nil {
+		return err
 	}
 
 	if exportData.Delta != nil {
 		for i := range exportData.Delta.Accts.Accts {
 			// Only update accounts with active voting keys
 			// Offline event is handled by ProcessTX_DFS while close out is handled here
-			// TODO: handle incentive rewards , they are implemented in protocol yet
+			// Incentive payouts are credited to the proposer balance and show up here as well
 			if exportData.Delta.Accts.Accts[i].VoteLastValid >= round ||
 				exportData.Delta.Accts.Accts[i].MicroAlgos == 0 {
 				oe.log.Infof("A:%s uA:%d", exportData.Delta.Accts.Accts[i].Addr, exportData.Delta.Accts.Accts[i].MicroAlgos)
@@ -197,37 +466,87 @@ func (oe *onlineExporter) Receive(exportData data.BlockData) error {
 		}
 	}
 
+	// block header participation updates are authoritative
+	pu := &exportData.BlockHeader.ParticipationUpdates
+	if mismatches := oe.onls.applyParticipationUpdates(round, pu); mismatches > 0 {
+		oe.log.WithFields(logrus.Fields{"round": round}).Warnf("Header participation updates disagree with state for %d accounts", mismatches)
+		expiryMismatchTotal.Add(float64(mismatches))
+	}
+	expiredAccountsTotal.Add(float64(len(pu.ExpiredParticipationAccounts)))
+
 	uAgg := false
+	lRound := uint64(round) + oe.onls.lag()
+	fullTiers := oe.onls.updateTiers(lRound, round, exportData.BlockHeader.TimeStamp)
 	if oe.onls.updateAggregate(round) {
 		uAgg = true
-		if err := oe.chdbExportAggregate(exportData.BlockHeader.TimeStamp); err != nil {
+		if err := oe.exportAggregate(oe.onls.aggBinRound(round), exportData.BlockHeader.TimeStamp); err != nil {
 			return err
 		}
 		oe.onls.resetAggregate(round)
 	}
+	if err := oe.exportTiers(fullTiers, lRound, round, exportData.BlockHeader.TimeStamp); err != nil {
+		return err
+	}
+
+	dirty := oe.onls.updateTotals(round)
+
+	// exportData.Delta.Totals.Online.Money matches plugin stake only in comparable rounds
+	var ta types.MicroAlgos = 0
+	tb := oe.onls.TotalStake
+	if exportData.Delta != nil {
+		ta = exportData.Delta.Totals.Online.Money
+		oe.drift.Check(round, ta, tb, oe.onls.isComparable(round))
+	}
+
+	if uAgg {
+		if err := oe.exportTotal(oe.onls.aggBinRound(round), exportData.BlockHeader.TimeStamp); err != nil {
+			return err
+		}
+	}
+
+	// stake changes only when totals were recalculated
+	if full := oe.isFullSnapshotRound(round); dirty || full {
+		if err := oe.exportSnapshot(uint64(round)+oe.onls.lag(), round, full); err != nil {
+			return err
+		}
+	}
 
-	if oe.onls.updateTotals(round) || !oe.batcher.isCatchup {
-		// if err := oe.chdbExportStake(); err != nil {
-		// 	return errs
-		// }
+	if err := oe.exportEvents(); err != nil {
+		return err
+	}
+
+	// state is queued after the exports of this round
+	// bundled bins are flushed together with the state so a restart can resume after them
+	flush := oe.batcher.Due()
+	if rnd, ok := oe.batcher.LastRound(); flush && ok {
+		oe.onls.SentBinRnd = rnd
+	}
+	persist := dirty || !oe.catchup.isCatchup || (flush && oe.isBatching())
+	if persist {
 		if err := oe.persistOnlineStakeState(); err != nil {
 			return err
 		}
 	}
 
-	if uAgg {
-		if err := oe.chdbExportTotal(exportData.BlockHeader.TimeStamp); err != nil {
+	if oe.isCheckpointRound(round) {
+		if err := oe.persistCheckpoint(); err != nil {
 			return err
 		}
 	}
 
-	// exportData.Delta.Totals.Online.Money does not reflect current online stake
-	//
-	var ta types.MicroAlgos = 0
-	tb := oe.onls.TotalStake
-	if exportData.Delta != nil {
-		ta = exportData.Delta.Totals.Online.Money
+	if flush {
+		if err := oe.batcher.Flush(); err != nil {
+			return err
+		}
 	}
+
+	// the round is complete and not retried, the next block is refused
+	if oe.drift.Err() != nil && oe.drift.policy == DriftRebuild {
+		if err := oe.discardOnlineStakeState(); err != nil {
+			oe.log.Errorf("Error discarding state: %v", err)
+		}
+	}
+
 	oe.log.WithFields(logrus.Fields{"round": round}).Infof("PluginOnlineStake:%duA Delta:%duA NextExpiryAt:%d", tb, int64(ta)-int64(tb), int64(oe.onls.NextExpiry))
 	return nil
 }
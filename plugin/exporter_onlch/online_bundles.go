@@ -1,81 +1,135 @@
 package exporter_onlch
 
 import (
-	"context"
-	"fmt"
 	"time"
 
-	"github.com/ClickHouse/clickhouse-go/v2"
-	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/sirupsen/logrus"
 )
 
+// aggregateRowBytes approximates exported size of a row without the address
+const aggregateRowBytes = 64
+
 type AggregateBundle struct {
-	batchLimit int
-	batches    int
-	batch      driver.Batch
-	insStr     string
-	chdb       clickhouse.Conn
-	ctx        context.Context
-	lastRound  uint64
-	lastTs     time.Time
-	isCatchup  bool
-	log        *logrus.Logger
+	maxBins     int
+	maxRows     int
+	maxBytes    int
+	maxInterval time.Duration
+	bins        []*aggregateBin
+	rows        int
+	bytes       int
+	firstAt     time.Time
+	send        func(bins []*aggregateBin) error
+	submit      func(job *writerJob) error
+	deferred    []*writerJob
+	isCatchup   bool
+	log         *logrus.Logger
 }
 
 func (oe *onlineExporter) MakeBatcher() *AggregateBundle {
 	ab := &AggregateBundle{
-		batchLimit: 0,
-		batches:    0,
-		batch:      nil,
-		insStr:     fmt.Sprintf("INSERT INTO " + oe.cfg.ChAggTab),
-		chdb:       oe.chdb,
-		ctx:        oe.ctx,
-		lastRound:  0,
-		lastTs:     time.Now(),
-		isCatchup:  false,
-		log:        oe.log,
+		maxBins: 1,
+		bins:    nil,
+		send: func(bins []*aggregateBin) error {
+			return oe.enqueue(&spoolEntry{Aggregates: bins})
+		},
+		submit: func(job *writerJob) error {
+			return oe.submit(job)
+		},
+		isCatchup: false,
+		log:       oe.log,
 	}
 	// Enable bundle of batches
-	if oe.cfg.ChAggBatch {
-		ab.batchLimit = 100
+	// deduplication tokens are per bin so bins are never bundled
+	if oe.isBatching() {
+		ab.maxBins = oe.cfg.ChAggBatchBins
+		ab.maxRows = oe.cfg.ChAggBatchRows
+		ab.maxBytes = oe.cfg.ChAggBatchBytes
+		ab.maxInterval = oe.cfg.ChAggBatchInterval
 	}
 	return ab
 }
 
-func (ab *AggregateBundle) Monitor(round uint64) bool {
-	now := time.Now()
-	tDelta := now.Sub(ab.lastTs)
-	ab.isCatchup = round-ab.lastRound == 1 && tDelta < time.Second
-	ab.lastTs = now
-	ab.lastRound = round
-	return ab.isCatchup
+// isBatching returns true if aggregate bins are bundled during catch-up
+func (oe *onlineExporter) isBatching() bool {
+	return oe.cfg.ChAggBatch && !oe.cfg.ChDedup
+}
+
+// Add appends finished bin to the bundle
+// bins are sent by Flush once the bundle is Due
+func (ab *AggregateBundle) Add(bin *aggregateBin) {
+	if len(ab.bins) == 0 {
+		ab.firstAt = time.Now()
+	}
+	ab.bins = append(ab.bins, bin)
+	ab.rows += len(bin.Rows)
+	for _, r := range bin.Rows {
+		ab.bytes += len(r.Addr) + aggregateRowBytes
+	}
+}
+
+// Due returns true if the bundle should be flushed
+// bins are bundled only while catching up and until one of the limits is reached
+func (ab *AggregateBundle) Due() bool {
+	switch {
+	case len(ab.bins) == 0:
+		return false
+	case !ab.isCatchup || len(ab.bins) >= ab.maxBins:
+		return true
+	case ab.maxRows > 0 && ab.rows >= ab.maxRows:
+		return true
+	case ab.maxBytes > 0 && ab.bytes >= ab.maxBytes:
+		return true
+	case ab.maxInterval > 0 && time.Since(ab.firstAt) >= ab.maxInterval:
+		return true
+	}
+	return false
+}
+
+// LastRound returns the round of the newest bundled bin of the aggregate table
+// tier and period bins are bundled with it but close at other rounds
+func (ab *AggregateBundle) LastRound() (uint64, bool) {
+	for i := len(ab.bins) - 1; i >= 0; i-- {
+		if ab.bins[i].Table == "" {
+			return ab.bins[i].Round, true
+		}
+	}
+	return 0, false
 }
 
-func (ab *AggregateBundle) GetBatch() (driver.Batch, error) {
-	if ab.batch == nil {
-		batch, err := ab.chdb.PrepareBatch(ab.ctx, ab.insStr)
-		if err != nil {
-			return nil, err
+// Flush sends all bundled bins followed by deferred state updates
+func (ab *AggregateBundle) Flush() error {
+	if len(ab.bins) > 0 {
+		if len(ab.bins) > 1 {
+			ab.log.Infof("Flushing bundle of %d batches", len(ab.bins))
+		}
+		bins := ab.bins
+		ab.bins, ab.rows, ab.bytes = nil, 0, 0
+		if err := ab.send(bins); err != nil {
+			return err
+		}
+	}
+	deferred := ab.deferred
+	ab.deferred = nil
+	for _, job := range deferred {
+		if err := ab.submit(job); err != nil {
+			return err
 		}
-		ab.batch = batch
 	}
-	return ab.batch, nil
+	return nil
 }
 
-func (ab *AggregateBundle) SmartFlush() error {
-	if ab.batch == nil {
-		return nil
+// Defer queues state update after the bundled bins
+// only the latest update of the same file is kept
+func (ab *AggregateBundle) Defer(job *writerJob) error {
+	if len(ab.bins) == 0 {
+		return ab.submit(job)
 	}
-	ab.batches++
-	if !ab.isCatchup || ab.batches > ab.batchLimit {
-		if ab.batches > 1 {
-			ab.log.Infof("Flushing bundle of %d batches", ab.batches)
+	for i, d := range ab.deferred {
+		if d.key == job.key {
+			ab.deferred[i] = job
+			return nil
 		}
-		err := ab.batch.Send()
-		ab.batch = nil
-		ab.batches = 0
-		return err
 	}
+	ab.deferred = append(ab.deferred, job)
 	return nil
 }
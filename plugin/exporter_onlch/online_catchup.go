@@ -0,0 +1,81 @@
+package exporter_onlch
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/algorand/go-algorand-sdk/v2/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCatchupEnter = time.Minute
+	defaultCatchupExit  = 15 * time.Second
+	// blockTimeSmoothing is the weight of the newest block interval in the average
+	blockTimeSmoothing = 0.05
+)
+
+// CatchupMonitor decides if the pipeline is catching up from block timestamp lag
+// catch-up starts when lag exceeds enter and ends when it drops under exit
+type CatchupMonitor struct {
+	enter     time.Duration
+	exit      time.Duration
+	isCatchup bool
+	lag       time.Duration
+	lagRounds int64
+	blockTime float64
+	lastRound types.Round
+	lastTs    int64
+	log       *logrus.Logger
+}
+
+func (oe *onlineExporter) MakeCatchupMonitor() (*CatchupMonitor, error) {
+	cm := &CatchupMonitor{
+		enter:     oe.cfg.CatchupEnter,
+		exit:      oe.cfg.CatchupExit,
+		blockTime: 2.8,
+		log:       oe.log,
+	}
+	if cm.enter <= 0 {
+		cm.enter = defaultCatchupEnter
+	}
+	if cm.exit <= 0 {
+		cm.exit = defaultCatchupExit
+	}
+	if cm.exit > cm.enter {
+		return nil, fmt.Errorf("catchup-exit %s over catchup-enter %s", cm.exit, cm.enter)
+	}
+	return cm, nil
+}
+
+// Monitor updates lag from block timestamp ts and returns true while catching up
+func (cm *CatchupMonitor) Monitor(round types.Round, ts int64) bool {
+	// average block time from consecutive timestamps, estimates lag in rounds
+	if round == cm.lastRound+1 && ts > cm.lastTs && cm.lastTs > 0 {
+		cm.blockTime += blockTimeSmoothing * (float64(ts-cm.lastTs) - cm.blockTime)
+	}
+	cm.lastRound, cm.lastTs = round, ts
+
+	cm.lag = time.Since(time.Unix(ts, 0))
+	if cm.lag < 0 {
+		cm.lag = 0
+	}
+	cm.lagRounds = int64(cm.lag.Seconds() / cm.blockTime)
+	catchupLagSeconds.Set(cm.lag.Seconds())
+	catchupLagRounds.Set(float64(cm.lagRounds))
+
+	switch {
+	case !cm.isCatchup && cm.lag > cm.enter:
+		cm.isCatchup = true
+		cm.log.WithFields(logrus.Fields{"round": round}).Infof("Catching up, %s", cm.Status())
+	case cm.isCatchup && cm.lag < cm.exit:
+		cm.isCatchup = false
+		cm.log.WithFields(logrus.Fields{"round": round}).Infof("Caught up, %s", cm.Status())
+	}
+	return cm.isCatchup
+}
+
+// Status returns human readable lag
+func (cm *CatchupMonitor) Status() string {
+	return fmt.Sprintf("lagging by %d rounds / %s", cm.lagRounds, cm.lag.Truncate(time.Second))
+}
@@ -1,19 +1,58 @@
 package exporter_onlch
 
-import "github.com/algorand/go-algorand-sdk/v2/types"
+import (
+	"time"
+
+	"github.com/algorand/go-algorand-sdk/v2/types"
+)
+
+// AggregateTier is an extra aggregate bin size or UTC period exported to its own table
+type AggregateTier struct {
+	Bin    int64  `yaml:"bin"`
+	Period string `yaml:"period"`
+	Table  string `yaml:"table"`
+	TTL    string `yaml:"ttl"`
+}
 
 type Config struct {
-	StateFile  string `yaml:"statefile"`
-	ChHost     string `yaml:"clickhouse-host"`
-	ChUser     string `yaml:"clickhouse-user"`
-	ChPass     string `yaml:"clickhouse-pass"`
-	ChDB       string `yaml:"clickhouse-db"`
-	ChTotTab   string `yaml:"total-table"`
-	ChOnlTab   string `yaml:"snapshot-table"`
-	ChAggTab   string `yaml:"aggregate-table"`
-	ChAggBin   int64  `yaml:"aggregate-bin"`
-	ChAggBatch bool   `yaml:"aggregate-batch"`
-	Debug      string `yaml:"debug"`
-	debugAddr  types.Address
-	datadir    string
+	StateFile          string          `yaml:"statefile"`
+	Network            string          `yaml:"network"`
+	Sinks              []string        `yaml:"sinks"`
+	ChHost             string          `yaml:"clickhouse-host"`
+	ChUser             string          `yaml:"clickhouse-user"`
+	ChPass             string          `yaml:"clickhouse-pass"`
+	ChDB               string          `yaml:"clickhouse-db"`
+	PgDSN              string          `yaml:"postgres-dsn"`
+	PgHwmTab           string          `yaml:"postgres-hwm-table"`
+	SqliteFile         string          `yaml:"sqlite-file"`
+	SqliteRollups      []AggregateTier `yaml:"sqlite-rollups"`
+	TotalTab           string          `yaml:"total-table"`
+	SnapshotTab        string          `yaml:"snapshot-table"`
+	SnapshotFull       int64           `yaml:"snapshot-full-interval"`
+	AggTab             string          `yaml:"aggregate-table"`
+	KeyregTab          string          `yaml:"keyreg-table"`
+	EventTab           string          `yaml:"events-table"`
+	ChAggBin           int64           `yaml:"aggregate-bin"`
+	Tiers              []AggregateTier `yaml:"aggregate-tiers"`
+	ChAggBatch         bool            `yaml:"aggregate-batch"`
+	ChAggBatchBins     int             `yaml:"aggregate-batch-bins"`
+	ChAggBatchRows     int             `yaml:"aggregate-batch-rows"`
+	ChAggBatchBytes    int             `yaml:"aggregate-batch-bytes"`
+	ChAggBatchInterval time.Duration   `yaml:"aggregate-batch-interval"`
+	CatchupEnter       time.Duration   `yaml:"catchup-enter"`
+	CatchupExit        time.Duration   `yaml:"catchup-exit"`
+	ChDedup            bool            `yaml:"dedup"`
+	ChVersion          bool            `yaml:"version-column"`
+	LegacyRewards      bool            `yaml:"legacy-rewards"`
+	DriftThreshold     int64           `yaml:"drift-threshold"`
+	DriftPolicy        string          `yaml:"drift-policy"`
+	Checkpoints        int             `yaml:"checkpoint-count"`
+	CheckpointInterval int64           `yaml:"checkpoint-interval"`
+	Reconcile          string          `yaml:"reconcile"`
+	SpoolFile          string          `yaml:"spool-file"`
+	ExportQueue        int             `yaml:"export-queue"`
+	Consensus          ConsensusTable  `yaml:"consensus"`
+	Debug              string          `yaml:"debug"`
+	debugAddr          types.Address
+	datadir            string
 }
@@ -1,14 +1,26 @@
 package exporter_onlch
 
 import (
+	"context"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/sirupsen/logrus"
 )
 
-// chdbInit instantiates ClickHouse client and pings the server
-func (oe *onlineExporter) chdbInit() error {
+// ClickHouseSink exports rows to ClickHouse tables
+type ClickHouseSink struct {
+	conn clickhouse.Conn
+	cfg  *Config
+	ctx  context.Context
+	log  *logrus.Logger
+}
+
+// MakeClickHouseSink instantiates ClickHouse client and pings the server
+func (oe *onlineExporter) MakeClickHouseSink() (*ClickHouseSink, error) {
 	var (
 		conn, err = clickhouse.Open(&clickhouse.Options{
 			Addr: []string{oe.cfg.ChHost},
@@ -25,112 +37,202 @@ func (oe *onlineExporter) chdbInit() error {
 		})
 	)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	ch := &ClickHouseSink{
+		conn: conn,
+		cfg:  &oe.cfg,
+		ctx:  oe.ctx,
+		log:  oe.log,
 	}
 	err = conn.Ping(oe.ctx)
-	if err != nil {
-		return err
+	if err != nil && oe.cfg.SpoolFile != "" {
+		// exports are spooled until ClickHouse is back
+		oe.log.Warnf("ClickHouse not available: %v", err)
+		return ch, nil
 	}
-	oe.chdb = conn
-	return nil
+	return ch, err
+}
+
+func (ch *ClickHouseSink) Name() string {
+	return SinkClickHouse
+}
+
+func (ch *ClickHouseSink) Close() error {
+	return ch.conn.Close()
 }
 
-// chdbExportStake exports whole stake state to ClickHouse table
-// adds extra row with "total" account address for quick per round total online stake
-func (oe *onlineExporter) chdbExportStake() error {
-	if oe.cfg.ChOnlTab == "" || oe.isDebugRun() {
-		//skip exporting snapshots to ClickHouse
-		return nil
+// insertCtx returns insert context with deterministic deduplication token for the bin
+// token is derived from table, bin round and digest of the inserted rows
+func (ch *ClickHouseSink) insertCtx(table string, rnd uint64, digest hash.Hash) context.Context {
+	if !ch.cfg.ChDedup {
+		return ch.ctx
 	}
-	batch, err := oe.chdb.PrepareBatch(oe.ctx, "INSERT INTO "+oe.cfg.ChOnlTab)
+	token := fmt.Sprintf("%s-%d-%s", table, rnd, hex.EncodeToString(digest.Sum(nil)))
+	return clickhouse.Context(ch.ctx, clickhouse.WithSettings(clickhouse.Settings{
+		"insert_deduplication_token": token,
+		"async_insert_deduplicate":   1,
+	}))
+}
+
+// chdbVersion returns row version for ReplacingMergeTree tables, the latest export wins
+func chdbVersion() uint64 {
+	return uint64(time.Now().UnixNano())
+}
+
+// SendSnapshot inserts snapshot rows into ClickHouse table
+func (ch *ClickHouseSink) SendSnapshot(rows []snapshotRow) error {
+	ctx := ch.insertCtx(ch.cfg.SnapshotTab, rows[0].Round, snapshotDigest(rows))
+	batch, err := ch.conn.PrepareBatch(ctx, "INSERT INTO "+ch.cfg.SnapshotTab)
 	if err != nil {
 		return err
 	}
-	var (
-		c_addr []string
-		c_rnd  []uint64
-		c_ma   []int64
-		c_sf   []float64
-	)
-	rnd := uint64(oe.onls.UpdatedAtRnd) + StakeLag
-	for _, acc := range oe.onls.Accounts {
-		c_addr = append(c_addr, acc.Addr)
-		c_rnd = append(c_rnd, rnd)
-		c_ma = append(c_ma, int64(acc.Stake))
-		c_sf = append(c_sf, acc.stakeFraction)
-	}
-	c_addr = append(c_addr, "total")
-	c_rnd = append(c_rnd, rnd)
-	c_ma = append(c_ma, int64(oe.onls.TotalStake))
-	c_sf = append(c_sf, 1.0)
+	for _, r := range rows {
+		if err := batch.Append(r.Addr, r.Round, r.Stake, r.SF); err != nil {
+			return err
+		}
+	}
+	return batch.Send()
+}
 
-	if err := batch.Column(0).Append(c_addr); err != nil {
+// SendEvents inserts event rows into ClickHouse table
+func (ch *ClickHouseSink) SendEvents(rows []eventRow) error {
+	ctx := ch.insertCtx(ch.cfg.EventTab, rows[0].Observed, eventDigest(rows))
+	batch, err := ch.conn.PrepareBatch(ctx, "INSERT INTO "+ch.cfg.EventTab)
+	if err != nil {
 		return err
 	}
-	if err := batch.Column(1).Append(c_rnd); err != nil {
-		return err
+	for _, r := range rows {
+		err := batch.Append(
+			r.Addr,
+			r.Round,
+			r.Observed,
+			r.OldState,
+			r.NewState,
+			r.Reason,
+			r.StakeBefore,
+			r.StakeAfter,
+		)
+		if err != nil {
+			return err
+		}
 	}
-	if err := batch.Column(2).Append(c_ma); err != nil {
+	return batch.Send()
+}
+
+// SendKeyregs inserts keyreg rows into ClickHouse table
+func (ch *ClickHouseSink) SendKeyregs(rows []keyregRow) error {
+	ctx := ch.insertCtx(ch.cfg.KeyregTab, rows[0].Round, keyregDigest(rows))
+	batch, err := ch.conn.PrepareBatch(ctx, "INSERT INTO "+ch.cfg.KeyregTab)
+	if err != nil {
 		return err
 	}
-	if err := batch.Column(3).Append(c_sf); err != nil {
-		return err
+	for _, r := range rows {
+		err := batch.Append(
+			r.Round,
+			r.Addr,
+			r.VoteFirst,
+			r.VoteLast,
+			r.KeyDilution,
+			r.VotePK,
+			r.SelectionPK,
+			r.StateProofPK,
+			r.NonParticipation,
+			r.Fee,
+			r.AuthAddr,
+			r.AppID,
+		)
+		if err != nil {
+			return err
+		}
 	}
 	return batch.Send()
 }
 
-// chdbExportTotal exports total stake state to ClickHouse table
-func (oe *onlineExporter) chdbExportTotal(ts int64) error {
-	if oe.cfg.ChTotTab == "" || oe.isDebugRun() {
-		//skip exporting snapshots to ClickHouse
-		return nil
-	}
-	rnd := uint64(oe.onls.lastRnd)
-	rnd -= rnd % uint64(oe.cfg.ChAggBin)
-	rnd += StakeLag
-
-	oe.log.Infof("Dumping total for round %d", rnd)
-
-	sql := fmt.Sprintf("INSERT INTO %s (round,ts,stake, maxStake, stakeRwd, onl, onlRwd) VALUES (%d,%d,%d,%d,%d,%d,%d)",
-		oe.cfg.ChTotTab,
-		rnd,
-		ts,
-		oe.onls.TotalStake,
-		oe.onls.MaxStake,
-		oe.onls.TotalStakeRwd,
-		oe.onls.OnlineCnt,
-		oe.onls.OnlineCntRwd,
+// SendTotal inserts total row into ClickHouse table
+func (ch *ClickHouseSink) SendTotal(t *totalRow) error {
+	values := fmt.Sprintf("%d,%d,%d,%d,%d,%d,%d,%d",
+		t.Round,
+		t.Ts,
+		t.Stake,
+		t.MaxStake,
+		t.StakeRwd,
+		t.Onl,
+		t.OnlRwd,
+		t.Drift,
 	)
-	return oe.chdb.AsyncInsert(oe.ctx, sql, false)
+	ctx := ch.insertCtx(ch.cfg.TotalTab, t.Round, t.digest())
+	sql := fmt.Sprintf("INSERT INTO %s (round,ts,stake, maxStake, stakeRwd, onl, onlRwd, drift) VALUES (%s)", ch.cfg.TotalTab, values)
+	if ch.cfg.ChVersion {
+		sql = fmt.Sprintf("INSERT INTO %s (round,ts,stake, maxStake, stakeRwd, onl, onlRwd, drift, ver) VALUES (%s,%d)", ch.cfg.TotalTab, values, chdbVersion())
+	}
+	return ch.conn.AsyncInsert(ctx, sql, false)
 }
 
-// chdbExportAggregate exports current stake aggregate to ClickHouse table
-func (oe *onlineExporter) chdbExportAggregate(ts int64) error {
-	if oe.cfg.ChAggTab == "" || oe.isDebugRun() {
-		//skip exporting aggregates to ClickHouse
-		return nil
+// SendAggregates inserts aggregate bins into ClickHouse tables, one batch per run of bins of the same table
+// or one batch per bin with deduplication
+func (ch *ClickHouseSink) SendAggregates(bins []*aggregateBin) error {
+	for len(bins) > 0 {
+		n := 1
+		// deduplication tokens are per bin so each bin is a batch of its own
+		for !ch.cfg.ChDedup && n < len(bins) && ch.cfg.binTable(bins[n]) == ch.cfg.binTable(bins[0]) {
+			n++
+		}
+		if err := ch.sendAggregateBatch(ch.cfg.binTable(bins[0]), bins[:n]); err != nil {
+			return err
+		}
+		bins = bins[n:]
 	}
+	return nil
+}
+
+// sendAggregateBatch inserts aggregate bins into ClickHouse table as a single batch
+func (ch *ClickHouseSink) sendAggregateBatch(table string, bins []*aggregateBin) error {
 	var (
 		c_addr   []string
 		c_rnd    []uint64
 		c_ts     []int64
 		c_rndOnl []int32
 		c_sfsum  []float64
+		c_prop   []int32
+		c_payout []uint64
+		c_fees   []uint64
+		c_stake  []float64
+		c_ratio  []float64
+		c_first  []uint64
+		c_last   []uint64
+		c_rounds []int32
+		c_ver    []uint64
 	)
-	batch, err := oe.batcher.GetBatch()
+	ctx := ch.ctx
+	if len(bins) == 1 {
+		ctx = ch.insertCtx(table, bins[0].Round, bins[0].digest())
+	}
+	batch, err := ch.conn.PrepareBatch(ctx, "INSERT INTO "+table)
 	if err != nil {
 		return err
 	}
 
-	rnd := uint64(oe.onls.lastRnd)
-	rnd -= rnd % uint64(oe.cfg.ChAggBin)
-	rnd += StakeLag
-	for _, acc := range oe.onls.Accounts {
-		c_addr = append(c_addr, acc.Addr)
-		c_rnd = append(c_rnd, rnd)
-		c_ts = append(c_ts, ts)
-		c_rndOnl = append(c_rndOnl, acc.AggOnline)
-		c_sfsum = append(c_sfsum, acc.AggSFSum)
+	ver := chdbVersion()
+	for _, bin := range bins {
+		for _, r := range bin.Rows {
+			c_addr = append(c_addr, r.Addr)
+			c_rnd = append(c_rnd, bin.Round)
+			c_ts = append(c_ts, bin.Ts)
+			c_rndOnl = append(c_rndOnl, r.RndsOnline)
+			c_sfsum = append(c_sfsum, r.SFSum)
+			c_prop = append(c_prop, r.Proposals)
+			c_payout = append(c_payout, r.PayoutSum)
+			c_fees = append(c_fees, r.Fees)
+			c_stake = append(c_stake, r.StakeSum)
+			c_ratio = append(c_ratio, r.PayoutRatio)
+			c_ver = append(c_ver, ver)
+			if bin.Period != nil {
+				c_first = append(c_first, bin.Period.First)
+				c_last = append(c_last, bin.Period.Last)
+				c_rounds = append(c_rounds, bin.Period.Rounds)
+			}
+		}
 	}
 
 	if err := batch.Column(0).Append(c_addr); err != nil {
@@ -148,5 +250,68 @@ func (oe *onlineExporter) chdbExportAggregate(ts int64) error {
 	if err := batch.Column(4).Append(c_sfsum); err != nil {
 		return err
 	}
-	return oe.batcher.SmartFlush()
+	if err := batch.Column(5).Append(c_prop); err != nil {
+		return err
+	}
+	if err := batch.Column(6).Append(c_payout); err != nil {
+		return err
+	}
+	if err := batch.Column(7).Append(c_fees); err != nil {
+		return err
+	}
+	if err := batch.Column(8).Append(c_stake); err != nil {
+		return err
+	}
+	if err := batch.Column(9).Append(c_ratio); err != nil {
+		return err
+	}
+	col := 10
+	// wall clock tiers record the processed round range of the period
+	if bins[0].Period != nil {
+		if err := batch.Column(10).Append(c_first); err != nil {
+			return err
+		}
+		if err := batch.Column(11).Append(c_last); err != nil {
+			return err
+		}
+		if err := batch.Column(12).Append(c_rounds); err != nil {
+			return err
+		}
+		col = 13
+	}
+	if ch.cfg.ChVersion {
+		if err := batch.Column(col).Append(c_ver); err != nil {
+			return err
+		}
+	}
+	return batch.Send()
+}
+
+// MaxRound returns the highest exported round in ClickHouse table
+func (ch *ClickHouseSink) MaxRound(table string) (uint64, bool, error) {
+	var (
+		cnt uint64
+		rnd uint64
+	)
+	row := ch.conn.QueryRow(ch.ctx, "SELECT count(), max(round) FROM "+table)
+	if err := row.Scan(&cnt, &rnd); err != nil {
+		return 0, false, err
+	}
+	return rnd, cnt > 0, nil
+}
+
+// DeleteAfter deletes rows after round from ClickHouse table
+func (ch *ClickHouseSink) DeleteAfter(table string, rnd uint64) error {
+	ch.log.Warnf("Deleting rows after round %d from %s", rnd, table)
+	return ch.conn.Exec(ch.ctx, fmt.Sprintf("ALTER TABLE %s DELETE WHERE round > %d SETTINGS mutations_sync = 1", table, rnd))
+}
+
+// Truncate deletes all rows from ClickHouse table
+func (ch *ClickHouseSink) Truncate(table string) error {
+	return ch.conn.Exec(ch.ctx, "TRUNCATE TABLE "+table)
+}
+
+// SetTTL sets TTL of ClickHouse table, ttl is a ClickHouse interval like "30 DAY"
+func (ch *ClickHouseSink) SetTTL(table string, ttl string) error {
+	return ch.conn.Exec(ch.ctx, fmt.Sprintf("ALTER TABLE %s MODIFY TTL ts + INTERVAL %s DELETE", table, ttl))
 }
@@ -0,0 +1,105 @@
+package exporter_onlch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/algorand/go-algorand-sdk/v2/types"
+)
+
+// checkpointName returns checkpoint file name for state processed up to round
+func (oe *onlineExporter) checkpointName(round types.Round) string {
+	return fmt.Sprintf("%s.%d", filepath.Join(oe.cfg.datadir, oe.cfg.StateFile), round)
+}
+
+// listCheckpoints returns checkpoint rounds sorted from oldest to newest
+func (oe *onlineExporter) listCheckpoints() ([]types.Round, error) {
+	prefix := filepath.Join(oe.cfg.datadir, oe.cfg.StateFile) + "."
+	matches, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	var rounds []types.Round
+	for _, m := range matches {
+		// skip temp files and discarded states
+		rnd, err := strconv.ParseUint(strings.TrimPrefix(m, prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		rounds = append(rounds, types.Round(rnd))
+	}
+	sort.Slice(rounds, func(i, j int) bool { return rounds[i] < rounds[j] })
+	return rounds, nil
+}
+
+// isCheckpointRound returns true if state should be checkpointed after processing round
+func (oe *onlineExporter) isCheckpointRound(round types.Round) bool {
+	return oe.cfg.Checkpoints > 0 && (int64(round)+1)%oe.cfg.CheckpointInterval == 0
+}
+
+// persistCheckpoint writes state checkpoint, like the state file it is written after all bins exported so far
+func (oe *onlineExporter) persistCheckpoint() error {
+	if oe.isDebugRun() {
+		return nil
+	}
+	job, err := oe.stateJob(oe.checkpointName(oe.onls.ProcessedRnd))
+	if err != nil {
+		return err
+	}
+	write := job.persist
+	job.persist = func() error {
+		if err := write(); err != nil {
+			return err
+		}
+		return oe.pruneCheckpoints()
+	}
+	return oe.batcher.Defer(job)
+}
+
+// pruneCheckpoints removes the oldest checkpoints over checkpoint-count
+func (oe *onlineExporter) pruneCheckpoints() error {
+	rounds, err := oe.listCheckpoints()
+	if err != nil {
+		return err
+	}
+	for len(rounds) > oe.cfg.Checkpoints {
+		if err := os.Remove(oe.checkpointName(rounds[0])); err != nil {
+			return err
+		}
+		rounds = rounds[1:]
+	}
+	return nil
+}
+
+// newestCheckpoint returns the newest checkpoint before nextRound
+func (oe *onlineExporter) newestCheckpoint(nextRound types.Round) (types.Round, bool, error) {
+	rounds, err := oe.listCheckpoints()
+	if err != nil {
+		return 0, false, err
+	}
+	for i := len(rounds) - 1; i >= 0; i-- {
+		if rounds[i] < nextRound {
+			return rounds[i], true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// findCheckpoint returns the newest checkpoint the pipeline can resume from at nextRound
+func (oe *onlineExporter) findCheckpoint(nextRound types.Round) (types.Round, error) {
+	cRnd, ok, err := oe.newestCheckpoint(nextRound)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("no checkpoint before round %d", nextRound)
+	}
+	if cRnd+1 != nextRound {
+		return 0, fmt.Errorf("newest checkpoint before round %d is at round %d, pipeline has to resume at round %d", nextRound, cRnd, cRnd+1)
+	}
+	return cRnd, nil
+}
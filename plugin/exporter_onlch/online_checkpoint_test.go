@@ -0,0 +1,132 @@
+package exporter_onlch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/algorand/go-algorand-sdk/v2/types"
+)
+
+// makeCheckpoints returns exporter with checkpoint files at rounds in a temp data dir
+// temp files and discarded states are created alongside and must be ignored
+func makeCheckpoints(t *testing.T, count int, rounds ...types.Round) *onlineExporter {
+	oe := &onlineExporter{}
+	oe.cfg.datadir = t.TempDir()
+	oe.cfg.StateFile = "state.json"
+	oe.cfg.Checkpoints = count
+	for _, rnd := range rounds {
+		if err := os.WriteFile(oe.checkpointName(rnd), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"state.json", "state.json.tmp123", "state.json.drift"} {
+		if err := os.WriteFile(filepath.Join(oe.cfg.datadir, name), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return oe
+}
+
+func TestFindCheckpoint(t *testing.T) {
+	tests := []struct {
+		name      string
+		rounds    []types.Round
+		nextRound types.Round
+		expected  types.Round
+		err       string
+	}{
+		{name: "exact", rounds: []types.Round{9, 19, 29}, nextRound: 20, expected: 19},
+		{name: "newest", rounds: []types.Round{9, 19, 29}, nextRound: 30, expected: 29},
+		{name: "numeric order", rounds: []types.Round{9, 99, 100}, nextRound: 101, expected: 100},
+		{name: "between checkpoints", rounds: []types.Round{9, 19, 29}, nextRound: 25, err: "pipeline has to resume at round 20"},
+		{name: "before oldest", rounds: []types.Round{9, 19}, nextRound: 9, err: "no checkpoint before round 9"},
+		{name: "none", nextRound: 10, err: "no checkpoint before round 10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oe := makeCheckpoints(t, 3, tt.rounds...)
+			rnd, err := oe.findCheckpoint(tt.nextRound)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rnd != tt.expected {
+				t.Errorf("checkpoint %d, expected %d", rnd, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPruneCheckpoints(t *testing.T) {
+	tests := []struct {
+		name     string
+		count    int
+		rounds   []types.Round
+		expected []types.Round
+	}{
+		{name: "under count", count: 3, rounds: []types.Round{9, 19}, expected: []types.Round{9, 19}},
+		{name: "at count", count: 2, rounds: []types.Round{9, 19}, expected: []types.Round{9, 19}},
+		{name: "oldest removed", count: 2, rounds: []types.Round{9, 19, 29, 39}, expected: []types.Round{29, 39}},
+		{name: "numeric order", count: 2, rounds: []types.Round{99, 100, 9}, expected: []types.Round{99, 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oe := makeCheckpoints(t, tt.count, tt.rounds...)
+			if err := oe.pruneCheckpoints(); err != nil {
+				t.Fatal(err)
+			}
+			rounds, err := oe.listCheckpoints()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(rounds, tt.expected) {
+				t.Errorf("checkpoints %v, expected %v", rounds, tt.expected)
+			}
+			// state file and other files are kept
+			for _, name := range []string{"state.json", "state.json.tmp123", "state.json.drift"} {
+				if _, err := os.Stat(filepath.Join(oe.cfg.datadir, name)); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestResumeRound(t *testing.T) {
+	tests := []struct {
+		name      string
+		processed types.Round
+		nextRound types.Round
+		expected  uint64
+	}{
+		{name: "in sync", processed: 29, nextRound: 30},
+		{name: "replays processed round", processed: 29, nextRound: 29, expected: 20},
+		{name: "went backwards", processed: 29, nextRound: 25, expected: 20},
+		{name: "behind the pipeline", processed: 29, nextRound: 35, expected: 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oe := makeCheckpoints(t, 3, 9, 19, 29)
+			payload := []byte(fmt.Sprintf(`{"updated":%d,"processed":%d}`, tt.processed, tt.processed))
+			if err := writeStateFile(filepath.Join(oe.cfg.datadir, oe.cfg.StateFile), tt.processed, types.Digest{}, payload); err != nil {
+				t.Fatal(err)
+			}
+			rnd, err := oe.resumeRound(tt.nextRound)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rnd != tt.expected {
+				t.Errorf("resume round %d, expected %d", rnd, tt.expected)
+			}
+		})
+	}
+}
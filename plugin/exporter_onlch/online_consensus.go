@@ -0,0 +1,108 @@
+package exporter_onlch
+
+import (
+	"math"
+
+	"github.com/algorand/go-algorand-sdk/v2/protocol"
+	"github.com/algorand/go-algorand-sdk/v2/protocol/config"
+	"github.com/algorand/go-algorand-sdk/v2/types"
+	"github.com/sirupsen/logrus"
+)
+
+// ConsensusParams are consensus parameters used by the exporter
+// configured per protocol version to cover protocols unknown to the SDK
+type ConsensusParams struct {
+	Lag        uint64           `yaml:"lag"`
+	MinBalance types.MicroAlgos `yaml:"min-balance"`
+	MaxBalance types.MicroAlgos `yaml:"max-balance"`
+	// block headers mark expired accounts offline
+	expiries bool
+}
+
+// ConsensusTable maps protocol versions to consensus parameters
+type ConsensusTable map[string]ConsensusParams
+
+// defaultConsensus is used until the protocol is known and for protocols without incentives
+var defaultConsensus = ConsensusParams{
+	Lag:        StakeLag,
+	MinBalance: 30000 * RewardUnit,
+	MaxBalance: types.MicroAlgos(math.Pow(2, 26) * RewardUnit),
+	expiries:   true,
+}
+
+// lookupConsensus returns parameters of protocol proto
+// configured overrides are merged over the SDK consensus table, defaults are used for protocols unknown to the SDK
+func lookupConsensus(overrides ConsensusTable, proto string) (ConsensusParams, bool) {
+	params := defaultConsensus
+	cp, known := config.Consensus[protocol.ConsensusVersion(proto)]
+	if known {
+		params.Lag = 2 * cp.SeedLookback * cp.SeedRefreshInterval
+		params.expiries = cp.MaxProposedExpiredOnlineAccounts > 0
+		if cp.Payouts.Enabled {
+			params.MinBalance = types.MicroAlgos(cp.Payouts.MinBalance)
+			params.MaxBalance = types.MicroAlgos(cp.Payouts.MaxBalance)
+		}
+	}
+	o, ok := overrides[proto]
+	if !ok {
+		return params, known
+	}
+	if o.Lag > 0 {
+		params.Lag = o.Lag
+	}
+	if o.MinBalance > 0 {
+		params.MinBalance = o.MinBalance
+	}
+	if o.MaxBalance > 0 {
+		params.MaxBalance = o.MaxBalance
+	}
+	return params, true
+}
+
+// lag returns the current stake lag
+func (onls *onlineStakeState) lag() uint64 {
+	if onls.consensus.Lag == 0 {
+		return StakeLag
+	}
+	return onls.consensus.Lag
+}
+
+// isEligible returns true if voting stake is within incentive eligibility bounds
+func (onls *onlineStakeState) isEligible(ma types.MicroAlgos) bool {
+	return ma >= onls.consensus.MinBalance && ma <= onls.consensus.MaxBalance
+}
+
+// setProtocol switches consensus parameters to protocol proto
+func (onls *onlineStakeState) setProtocol(round types.Round, proto string) {
+	if proto == "" || (proto == onls.Protocol && onls.consensus.Lag > 0) {
+		return
+	}
+	params, ok := lookupConsensus(onls.overrides, proto)
+	if !ok && onls.fallback.Lag > 0 {
+		// network preset covers protocols unknown to the SDK
+		params, ok = onls.fallback, true
+	}
+	if !ok {
+		onls.log.WithFields(logrus.Fields{"round": round}).Warnf("Unknown protocol %s, keeping lag %d and eligibility %d..%d", proto, onls.lag(), onls.consensus.MinBalance, onls.consensus.MaxBalance)
+		if onls.consensus.Lag > 0 {
+			params = onls.consensus
+		}
+	}
+	if onls.consensus.Lag > 0 && params.Lag != onls.consensus.Lag {
+		onls.log.WithFields(logrus.Fields{"round": round}).Warnf("Stake lag changes from %d to %d", onls.consensus.Lag, params.Lag)
+	}
+	onls.log.WithFields(logrus.Fields{"round": round}).Infof("Protocol %s : lag %d, eligibility %.0f..%.0f", proto, params.Lag, params.MinBalance.ToAlgos(), params.MaxBalance.ToAlgos())
+	onls.Protocol = proto
+	onls.consensus = params
+	// eligible totals change with the bounds
+	onls.dirty = true
+}
+
+// updateProtocol switches consensus parameters when the lag shifted round reaches a protocol upgrade
+func (onls *onlineStakeState) updateProtocol(round types.Round, hdr *types.BlockHeader) {
+	proto := string(hdr.CurrentProtocol)
+	if sw := hdr.NextProtocolSwitchOn; sw > 0 && hdr.NextProtocol != "" && uint64(round)+onls.lag() >= uint64(sw) {
+		proto = string(hdr.NextProtocol)
+	}
+	onls.setProtocol(round, proto)
+}
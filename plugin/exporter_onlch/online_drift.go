@@ -0,0 +1,67 @@
+package exporter_onlch
+
+import (
+	"fmt"
+
+	"github.com/algorand/go-algorand-sdk/v2/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DriftWarn    = "warn"
+	DriftHalt    = "halt"
+	DriftRebuild = "rebuild"
+)
+
+// DriftMonitor compares plugin online stake with ledger online totals
+type DriftMonitor struct {
+	threshold int64
+	policy    string
+	drift     int64
+	err       error
+	log       *logrus.Logger
+}
+
+func (oe *onlineExporter) MakeDriftMonitor() (*DriftMonitor, error) {
+	dm := &DriftMonitor{
+		threshold: oe.cfg.DriftThreshold,
+		policy:    oe.cfg.DriftPolicy,
+		log:       oe.log,
+	}
+	switch dm.policy {
+	case "":
+		dm.policy = DriftWarn
+	case DriftWarn, DriftHalt, DriftRebuild:
+	default:
+		return nil, fmt.Errorf("unknown drift-policy %q", dm.policy)
+	}
+	return dm, nil
+}
+
+// Check records drift between ledger online money and plugin online stake
+// drift over threshold halts the pipeline after the round unless policy is warn
+func (dm *DriftMonitor) Check(round types.Round, ledger types.MicroAlgos, plugin types.MicroAlgos, comparable bool) {
+	if !comparable {
+		return
+	}
+	dm.drift = int64(ledger) - int64(plugin)
+	onlineStakeDrift.Set(float64(dm.drift))
+	absDrift := dm.drift
+	if absDrift < 0 {
+		absDrift = -absDrift
+	}
+	if dm.threshold <= 0 || absDrift <= dm.threshold {
+		return
+	}
+	dm.log.WithFields(logrus.Fields{"round": round}).Warnf("Online stake drift %duA over threshold %duA", dm.drift, dm.threshold)
+	if dm.policy == DriftWarn {
+		return
+	}
+	dm.err = fmt.Errorf("online stake drift %duA at round %d over threshold %duA", dm.drift, round, dm.threshold)
+}
+
+// Err returns the error halting the pipeline
+// the round drift was measured in is processed and saved, so a retried block is not counted twice
+func (dm *DriftMonitor) Err() error {
+	return dm.err
+}
@@ -0,0 +1,144 @@
+package exporter_onlch
+
+import (
+	"encoding/base64"
+
+	"github.com/algorand/go-algorand-sdk/v2/types"
+)
+
+// exportSnapshot exports stake of accounts changed since the last snapshot
+// accounts that stopped voting get a 0 stake row, full exports all voting accounts
+// adds extra row with "total" account address for quick per round total online stake
+func (oe *onlineExporter) exportSnapshot(rnd uint64, round types.Round, full bool) error {
+	if oe.cfg.SnapshotTab == "" || oe.isDebugRun() {
+		//skip exporting snapshots
+		return nil
+	}
+	var rows []snapshotRow
+	for _, acc := range oe.onls.sortedAccounts() {
+		stake := acc.snapshotStake(round)
+		if stake == acc.SnapStake && !(full && stake > 0) {
+			continue
+		}
+		acc.SnapStake = stake
+		rows = append(rows, snapshotRow{
+			Addr:  acc.Addr,
+			Round: rnd,
+			Stake: int64(stake),
+			SF:    acc.stakeFraction,
+		})
+	}
+	rows = append(rows, snapshotRow{
+		Addr:  "total",
+		Round: rnd,
+		Stake: int64(oe.onls.TotalStake),
+		SF:    1.0,
+	})
+	return oe.enqueue(&spoolEntry{Snapshot: rows})
+}
+
+// exportEvents exports account state transitions recorded since the last export
+func (oe *onlineExporter) exportEvents() error {
+	if len(oe.onls.events) == 0 {
+		return nil
+	}
+	rows := oe.onls.events
+	oe.onls.events = nil
+	if oe.cfg.EventTab == "" || oe.isDebugRun() {
+		//skip exporting events
+		return nil
+	}
+	return oe.enqueue(&spoolEntry{Events: rows})
+}
+
+// exportKeyregs exports key registrations collected in the current round
+func (oe *onlineExporter) exportKeyregs() error {
+	if len(oe.keyregs) == 0 {
+		return nil
+	}
+	defer func() { oe.keyregs = oe.keyregs[:0] }()
+	if oe.cfg.KeyregTab == "" || oe.isDebugRun() {
+		//skip exporting keyregs
+		return nil
+	}
+	rows := make([]keyregRow, 0, len(oe.keyregs))
+	for _, k := range oe.keyregs {
+		auth := ""
+		if !k.auth.IsZero() {
+			auth = k.auth.String()
+		}
+		rows = append(rows, keyregRow{
+			Round:            uint64(k.round),
+			Addr:             k.sender.String(),
+			VoteFirst:        uint64(k.kr.VoteFirst),
+			VoteLast:         uint64(k.kr.VoteLast),
+			KeyDilution:      k.kr.VoteKeyDilution,
+			VotePK:           base64.StdEncoding.EncodeToString(k.kr.VotePK[:]),
+			SelectionPK:      base64.StdEncoding.EncodeToString(k.kr.SelectionPK[:]),
+			StateProofPK:     base64.StdEncoding.EncodeToString(k.kr.StateProofPK[:]),
+			NonParticipation: k.kr.Nonparticipation,
+			Fee:              uint64(k.fee),
+			AuthAddr:         auth,
+			AppID:            uint64(k.appID),
+		})
+	}
+	return oe.enqueue(&spoolEntry{Keyregs: rows})
+}
+
+// exportTotal exports total stake state
+func (oe *onlineExporter) exportTotal(rnd uint64, ts int64) error {
+	if oe.cfg.TotalTab == "" || oe.isDebugRun() {
+		//skip exporting totals
+		return nil
+	}
+	oe.log.Infof("Dumping total for round %d", rnd)
+	return oe.enqueue(&spoolEntry{Total: &totalRow{
+		Round:    rnd,
+		Ts:       ts,
+		Stake:    int64(oe.onls.TotalStake),
+		MaxStake: int64(oe.onls.MaxStake),
+		StakeRwd: int64(oe.onls.TotalStakeRwd),
+		Onl:      oe.onls.OnlineCnt,
+		OnlRwd:   oe.onls.OnlineCntRwd,
+		Drift:    oe.drift.drift,
+	}})
+}
+
+// exportAggregate exports current stake aggregate
+func (oe *onlineExporter) exportAggregate(rnd uint64, ts int64) error {
+	if oe.cfg.AggTab == "" || oe.isDebugRun() {
+		//skip exporting aggregates
+		return nil
+	}
+	bin := &aggregateBin{
+		Round: rnd,
+		Ts:    ts,
+		Rows:  make([]aggregateRow, 0, len(oe.onls.Accounts)),
+	}
+	for _, acc := range oe.onls.sortedAccounts() {
+		// kept only for longer tiers
+		if acc.state != Online && acc.AggOnline == 0 && acc.AggProposals == 0 {
+			continue
+		}
+		bin.Rows = append(bin.Rows, aggregateRow{
+			Addr:        acc.Addr,
+			RndsOnline:  acc.AggOnline,
+			SFSum:       acc.AggSFSum,
+			Proposals:   acc.AggProposals,
+			PayoutSum:   uint64(acc.AggPayout),
+			Fees:        uint64(acc.AggFees),
+			StakeSum:    acc.AggStakeSum,
+			PayoutRatio: acc.payoutRatio(),
+		})
+	}
+	oe.batcher.Add(bin)
+	return nil
+}
+
+// binTable returns target table of aggregate bin
+func (cfg *Config) binTable(bin *aggregateBin) string {
+	if bin.Table == "" {
+		return cfg.AggTab
+	}
+	return bin.Table
+}
@@ -0,0 +1,82 @@
+package exporter_onlch
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/algorand/conduit/conduit/data"
+)
+
+var (
+	// expiredAccountsTotal counts accounts listed as expired in block headers
+	expiredAccountsTotal prometheus.Counter
+	// expiryMismatchTotal counts disagreements between header participation updates and the VoteLast heuristic
+	expiryMismatchTotal prometheus.Counter
+	// onlineStakeDrift is the last measured ledger minus plugin online stake
+	onlineStakeDrift prometheus.Gauge
+	// spoolEntries is the number of exports waiting in the spool
+	spoolEntries prometheus.Gauge
+	// spoolBytes is the spool file size
+	spoolBytes prometheus.Gauge
+	// spoolAgeSeconds is the age of the oldest spooled export
+	spoolAgeSeconds prometheus.Gauge
+	// exportQueueDepth is the number of jobs waiting for the background writer
+	exportQueueDepth prometheus.Gauge
+	// catchupLagSeconds is the age of the last processed block
+	catchupLagSeconds prometheus.Gauge
+	// catchupLagRounds is the estimated number of rounds behind the network
+	catchupLagRounds prometheus.Gauge
+)
+
+func init() {
+	initMetrics(data.DefaultMetricsPrefix)
+}
+
+// initMetrics creates all plugin metrics in subsystem and returns them
+func initMetrics(subsystem string) []prometheus.Collector {
+	expiredAccountsTotal = initCounter(subsystem, "online_expired_accounts_total", "Accounts listed in block header ExpiredParticipationAccounts.")
+	expiryMismatchTotal = initCounter(subsystem, "online_expiry_mismatch_total", "Header expirations and absences the exporter state did not expect, and expected expirations missing from headers.")
+	onlineStakeDrift = initGauge(subsystem, "online_stake_drift_microalgos", "Ledger online money minus plugin online stake in the last comparable round.")
+	spoolEntries = initGauge(subsystem, "online_spool_entries", "Exports waiting in the sink spool.")
+	spoolBytes = initGauge(subsystem, "online_spool_bytes", "Sink spool file size in bytes.")
+	spoolAgeSeconds = initGauge(subsystem, "online_spool_age_sec", "Age of the oldest export in the sink spool in seconds.")
+	exportQueueDepth = initGauge(subsystem, "online_export_queue", "Exports and state updates waiting for the background writer.")
+	catchupLagSeconds = initGauge(subsystem, "online_lag_sec", "Wall clock time since the last processed block timestamp in seconds.")
+	catchupLagRounds = initGauge(subsystem, "online_lag_rounds", "Estimated rounds behind the network.")
+	return []prometheus.Collector{
+		expiredAccountsTotal,
+		expiryMismatchTotal,
+		onlineStakeDrift,
+		spoolEntries,
+		spoolBytes,
+		spoolAgeSeconds,
+		exportQueueDepth,
+		catchupLagSeconds,
+		catchupLagRounds,
+	}
+}
+
+func initCounter(subsystem string, name string, help string) prometheus.Counter {
+	return prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Subsystem: subsystem,
+			Name:      name,
+			Help:      help,
+		})
+}
+
+func initGauge(subsystem string, name string, help string) prometheus.Gauge {
+	return prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: subsystem,
+			Name:      name,
+			Help:      help,
+		})
+}
+
+func (oe *onlineExporter) ProvideMetrics(subsystem string) []prometheus.Collector {
+	collectors := initMetrics(subsystem)
+	if oe.spool != nil {
+		oe.spool.updateMetrics()
+	}
+	return collectors
+}
@@ -0,0 +1,78 @@
+package exporter_onlch
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/algorand/go-algorand-sdk/v2/types"
+)
+
+const (
+	NetworkMainnet  = "mainnet"
+	NetworkTestnet  = "testnet"
+	NetworkBetanet  = "betanet"
+	NetworkLocalnet = "localnet"
+)
+
+// networkPreset holds defaults of a named network
+// consensus is used for protocols unknown to the SDK, genesisID is not checked if empty
+type networkPreset struct {
+	genesisID string
+	consensus ConsensusParams
+	aggBin    int64
+}
+
+// incentives are the consensus parameters of public networks with block incentives
+var incentives = ConsensusParams{
+	Lag:        StakeLag,
+	MinBalance: 30000 * RewardUnit,
+	MaxBalance: 70_000_000 * RewardUnit,
+	expiries:   true,
+}
+
+var networkPresets = map[string]networkPreset{
+	NetworkMainnet:  {genesisID: "mainnet-v1.0", consensus: incentives, aggBin: 10},
+	NetworkTestnet:  {genesisID: "testnet-v1.0", consensus: incentives, aggBin: 10},
+	NetworkBetanet:  {genesisID: "betanet-v1.0", consensus: incentives, aggBin: 10},
+	NetworkLocalnet: {consensus: defaultConsensus, aggBin: 1},
+}
+
+// applyNetwork sets defaults of the configured network preset
+func (oe *onlineExporter) applyNetwork() error {
+	if oe.cfg.Network == "" {
+		return nil
+	}
+	preset, ok := networkPresets[oe.cfg.Network]
+	if !ok {
+		return fmt.Errorf("unknown network %q", oe.cfg.Network)
+	}
+	if oe.cfg.ChAggBin <= 0 {
+		oe.cfg.ChAggBin = preset.aggBin
+	}
+	return nil
+}
+
+// checkNetwork verifies that genesis belongs to the configured network
+func (oe *onlineExporter) checkNetwork(gen *types.Genesis) error {
+	preset := networkPresets[oe.cfg.Network]
+	if preset.genesisID != "" && gen.ID() != preset.genesisID {
+		return fmt.Errorf("network %s expects genesis %s, pipeline genesis is %s", oe.cfg.Network, preset.genesisID, gen.ID())
+	}
+	return nil
+}
+
+// checkStateGenesis refuses state saved for another genesis
+// states saved before genesis was recorded are adopted
+func (oe *onlineExporter) checkStateGenesis(onls *onlineStakeState) error {
+	gen := onls.ip.GetGenesis()
+	gh := base64.StdEncoding.EncodeToString(oe.genesisHash[:])
+	switch {
+	case onls.GenesisID == "" && onls.GenesisHash == "":
+		oe.log.Warnf("State has no genesis, assuming %s", gen.ID())
+	case onls.GenesisID != gen.ID() || onls.GenesisHash != gh:
+		return fmt.Errorf("state genesis %s (%s) does not match %s (%s)", onls.GenesisID, onls.GenesisHash, gen.ID(), gh)
+	}
+	onls.GenesisID = gen.ID()
+	onls.GenesisHash = gh
+	return nil
+}
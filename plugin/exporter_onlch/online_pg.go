@@ -0,0 +1,197 @@
+package exporter_onlch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultPgHwmTab = "online_export_hwm"
+
+// PostgresSink exports rows to PostgreSQL / TimescaleDB tables
+type PostgresSink struct {
+	sqlRows
+	pool   *pgxpool.Pool
+	hwmTab string
+	ready  bool
+	cfg    *Config
+	ctx    context.Context
+	log    *logrus.Logger
+}
+
+// MakePostgresSink instantiates PostgreSQL connection pool and creates the high-water mark table
+func (oe *onlineExporter) MakePostgresSink() (*PostgresSink, error) {
+	if oe.cfg.PgDSN == "" {
+		return nil, fmt.Errorf("postgres sink requires postgres-dsn")
+	}
+	pool, err := pgxpool.New(oe.ctx, oe.cfg.PgDSN)
+	if err != nil {
+		return nil, err
+	}
+	pg := &PostgresSink{
+		pool:   pool,
+		hwmTab: oe.cfg.PgHwmTab,
+		cfg:    &oe.cfg,
+		ctx:    oe.ctx,
+		log:    oe.log,
+	}
+	pg.sqlRows = sqlRows{w: pg, cfg: &oe.cfg}
+	if pg.hwmTab == "" {
+		pg.hwmTab = defaultPgHwmTab
+	}
+	err = pg.init()
+	if err != nil && oe.cfg.SpoolFile != "" {
+		// exports are spooled until PostgreSQL is back
+		oe.log.Warnf("PostgreSQL not available: %v", err)
+		return pg, nil
+	}
+	return pg, err
+}
+
+// init creates the high-water mark table once the server is reachable
+func (pg *PostgresSink) init() error {
+	if pg.ready {
+		return nil
+	}
+	sql := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (tbl text PRIMARY KEY, round bigint NOT NULL)", pg.hwmTab)
+	if _, err := pg.pool.Exec(pg.ctx, sql); err != nil {
+		return err
+	}
+	pg.ready = true
+	return nil
+}
+
+func (pg *PostgresSink) Name() string {
+	return SinkPostgres
+}
+
+func (pg *PostgresSink) Close() error {
+	pg.pool.Close()
+	return nil
+}
+
+// pgIdentifier splits optionally schema qualified table name
+func pgIdentifier(table string) pgx.Identifier {
+	return pgx.Identifier(strings.Split(table, "."))
+}
+
+// hwm returns the high-water mark of table in transaction tx, locking it until commit
+func (pg *PostgresSink) hwm(tx pgx.Tx, table string) (uint64, bool, error) {
+	var rnd int64
+	err := tx.QueryRow(pg.ctx, fmt.Sprintf("SELECT round FROM %s WHERE tbl = $1 FOR UPDATE", pg.hwmTab), table).Scan(&rnd)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return uint64(rnd), true, nil
+}
+
+// insert copies chunks newer than the high-water mark into table and moves the mark in one transaction
+func (pg *PostgresSink) insert(table string, columns []string, chunks []sqlChunk) error {
+	if err := pg.init(); err != nil {
+		return err
+	}
+	tx, err := pg.pool.Begin(pg.ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(pg.ctx)
+
+	hwm, exists, err := pg.hwm(tx, table)
+	if err != nil {
+		return err
+	}
+	fresh, last := freshChunks(pg.log, table, chunks, hwm, exists)
+	if len(fresh) == 0 {
+		return nil
+	}
+	var rows [][]any
+	for _, c := range fresh {
+		rows = append(rows, c.rows...)
+	}
+	if len(rows) > 0 {
+		if _, err := tx.CopyFrom(pg.ctx, pgIdentifier(table), columns, pgx.CopyFromRows(rows)); err != nil {
+			return err
+		}
+	}
+	sql := fmt.Sprintf("INSERT INTO %s (tbl, round) VALUES ($1, $2) ON CONFLICT (tbl) DO UPDATE SET round = EXCLUDED.round", pg.hwmTab)
+	if _, err := tx.Exec(pg.ctx, sql, table, int64(last)); err != nil {
+		return err
+	}
+	return tx.Commit(pg.ctx)
+}
+
+// timestamp returns ts as timestamptz value
+func (pg *PostgresSink) timestamp(ts int64) any {
+	return time.Unix(ts, 0).UTC()
+}
+
+// MaxRound returns the high-water mark of table
+func (pg *PostgresSink) MaxRound(table string) (uint64, bool, error) {
+	if err := pg.init(); err != nil {
+		return 0, false, err
+	}
+	var rnd int64
+	err := pg.pool.QueryRow(pg.ctx, fmt.Sprintf("SELECT round FROM %s WHERE tbl = $1", pg.hwmTab), table).Scan(&rnd)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return uint64(rnd), true, nil
+}
+
+// DeleteAfter deletes rows after round from table and moves the high-water mark back to the remaining rows
+func (pg *PostgresSink) DeleteAfter(table string, rnd uint64) error {
+	pg.log.Warnf("Deleting rows after round %d from %s", rnd, table)
+	tx, err := pg.pool.Begin(pg.ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(pg.ctx)
+	if _, err := tx.Exec(pg.ctx, fmt.Sprintf("DELETE FROM %s WHERE round > $1", pgIdentifier(table).Sanitize()), int64(rnd)); err != nil {
+		return err
+	}
+	var last *int64
+	if err := tx.QueryRow(pg.ctx, fmt.Sprintf("SELECT max(round) FROM %s", pgIdentifier(table).Sanitize())).Scan(&last); err != nil {
+		return err
+	}
+	if last == nil {
+		_, err = tx.Exec(pg.ctx, fmt.Sprintf("DELETE FROM %s WHERE tbl = $1", pg.hwmTab), table)
+	} else {
+		_, err = tx.Exec(pg.ctx, fmt.Sprintf("UPDATE %s SET round = $2 WHERE tbl = $1", pg.hwmTab), table, *last)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(pg.ctx)
+}
+
+// Truncate deletes all rows from table together with its high-water mark
+func (pg *PostgresSink) Truncate(table string) error {
+	tx, err := pg.pool.Begin(pg.ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(pg.ctx)
+	if _, err := tx.Exec(pg.ctx, "TRUNCATE TABLE "+pgIdentifier(table).Sanitize()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(pg.ctx, fmt.Sprintf("DELETE FROM %s WHERE tbl = $1", pg.hwmTab), table); err != nil {
+		return err
+	}
+	return tx.Commit(pg.ctx)
+}
+
+// SetTTL is not supported, use TimescaleDB retention policies instead
+func (pg *PostgresSink) SetTTL(table string, ttl string) error {
+	pg.log.Warnf("Ignoring TTL of %s in PostgreSQL, add a retention policy instead", table)
+	return nil
+}
@@ -0,0 +1,85 @@
+package exporter_onlch
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/algorand/conduit/conduit/plugins"
+	"github.com/algorand/go-algorand-sdk/v2/types"
+)
+
+// conduitMetadata is the part of the conduit pipeline metadata read before Init
+type conduitMetadata struct {
+	NextRound types.Round `json:"next-round"`
+}
+
+// stateRounds are the rounds of persisted state needed to pick the resume round
+type stateRounds struct {
+	UpdatedAtRnd types.Round `json:"updated"`
+	ProcessedRnd types.Round `json:"processed"`
+}
+
+// pipelineNextRound returns the next round saved by conduit
+// the metadata file is in the conduit data dir, the parent of the plugin data dir
+func pipelineNextRound(dataDir string) (types.Round, bool, error) {
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(dataDir), "metadata.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	var md conduitMetadata
+	if err := json.Unmarshal(content, &md); err != nil {
+		return 0, false, err
+	}
+	return md.NextRound, true, nil
+}
+
+// RoundRequest moves the pipeline to the round the persisted state can resume from
+// it is called by conduit before Init, problems with the configuration or state are reported by Init
+func (oe *onlineExporter) RoundRequest(cfg plugins.PluginConfig) (uint64, error) {
+	var c Config
+	if err := cfg.UnmarshalConfig(&c); err != nil || c.Debug != "" || c.StateFile == "" || cfg.DataDir == "" {
+		return 0, nil
+	}
+	nextRound, ok, err := pipelineNextRound(cfg.DataDir)
+	if err != nil || !ok {
+		return 0, err
+	}
+	req := &onlineExporter{cfg: c}
+	req.cfg.datadir = cfg.DataDir
+	return req.resumeRound(nextRound)
+}
+
+// resumeRound returns the pipeline round persisted state resumes from, 0 keeps nextRound
+func (oe *onlineExporter) resumeRound(nextRound types.Round) (uint64, error) {
+	if nextRound == 0 {
+		return 0, nil
+	}
+	sf, err := loadStateFile(filepath.Join(oe.cfg.datadir, oe.cfg.StateFile))
+	if err != nil && !errors.Is(err, errLegacyState) {
+		return 0, nil
+	}
+	var st stateRounds
+	if err := json.Unmarshal(sf.State, &st); err != nil {
+		return 0, nil
+	}
+
+	// pipeline went backwards, the last processed round would be replayed
+	if oe.cfg.Checkpoints > 0 && (nextRound < st.UpdatedAtRnd || nextRound <= st.ProcessedRnd) {
+		cRnd, ok, err := oe.newestCheckpoint(nextRound)
+		if err != nil || !ok {
+			return 0, err
+		}
+		return uint64(cRnd) + 1, nil
+	}
+	// rounds processed after the saved state were lost, the pipeline has to resume right after it
+	// legacy states without processed round are not checked
+	if (st.ProcessedRnd > 0 || st.UpdatedAtRnd == 0) && nextRound > st.ProcessedRnd+1 {
+		return uint64(st.ProcessedRnd) + 1, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,125 @@
+package exporter_onlch
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+)
+
+// aggregateRow is exported aggregate state of a single account
+type aggregateRow struct {
+	Addr        string  `json:"addr"`
+	RndsOnline  int32   `json:"rndsOnline"`
+	SFSum       float64 `json:"sfSum"`
+	Proposals   int32   `json:"proposals"`
+	PayoutSum   uint64  `json:"payoutSum"`
+	Fees        uint64  `json:"feesCollected"`
+	StakeSum    float64 `json:"stakeSum"`
+	PayoutRatio float64 `json:"payoutRatio"`
+}
+
+// aggregateBin is an immutable snapshot of a finished aggregate bin
+// Table is empty for the aggregate-table, Period is set for wall clock tiers
+type aggregateBin struct {
+	Table  string         `json:"table,omitempty"`
+	Round  uint64         `json:"round"`
+	Ts     int64          `json:"ts"`
+	Period *periodBin     `json:"period,omitempty"`
+	Rows   []aggregateRow `json:"rows"`
+}
+
+// totalRow is exported total stake state of an aggregate bin
+type totalRow struct {
+	Round    uint64 `json:"round"`
+	Ts       int64  `json:"ts"`
+	Stake    int64  `json:"stake"`
+	MaxStake int64  `json:"maxStake"`
+	StakeRwd int64  `json:"stakeRwd"`
+	Onl      int    `json:"onl"`
+	OnlRwd   int    `json:"onlRwd"`
+	Drift    int64  `json:"drift"`
+}
+
+// snapshotRow is exported stake of a single account, "total" row holds total online stake
+type snapshotRow struct {
+	Addr  string  `json:"addr"`
+	Round uint64  `json:"round"`
+	Stake int64   `json:"stake"`
+	SF    float64 `json:"sf"`
+}
+
+// eventRow is exported account state transition
+// Round is the lag shifted round the transition takes effect, Observed is the round it was processed
+type eventRow struct {
+	Addr        string `json:"addr"`
+	Round       uint64 `json:"round"`
+	Observed    uint64 `json:"observed"`
+	OldState    string `json:"oldState"`
+	NewState    string `json:"newState"`
+	Reason      string `json:"reason"`
+	StakeBefore int64  `json:"stakeBefore"`
+	StakeAfter  int64  `json:"stakeAfter"`
+}
+
+// keyregRow is exported key registration (inner)transaction
+type keyregRow struct {
+	Round            uint64 `json:"round"`
+	Addr             string `json:"addr"`
+	VoteFirst        uint64 `json:"voteFirst"`
+	VoteLast         uint64 `json:"voteLast"`
+	KeyDilution      uint64 `json:"keyDilution"`
+	VotePK           string `json:"votePK"`
+	SelectionPK      string `json:"selectionPK"`
+	StateProofPK     string `json:"stateProofPK"`
+	NonParticipation bool   `json:"nonParticipation"`
+	Fee              uint64 `json:"fee"`
+	AuthAddr         string `json:"authAddr"`
+	AppID            uint64 `json:"appId"`
+}
+
+// digest returns hash of bin rows for deduplication tokens
+func (bin *aggregateBin) digest() hash.Hash {
+	h := sha256.New()
+	if bin.Period != nil {
+		fmt.Fprintln(h, bin.Period.Start, bin.Period.First, bin.Period.Last, bin.Period.Rounds)
+	}
+	for _, r := range bin.Rows {
+		fmt.Fprintln(h, r.Addr, r.RndsOnline, r.SFSum, r.Proposals, r.PayoutSum, r.Fees, r.StakeSum)
+	}
+	return h
+}
+
+// digest returns hash of total row for deduplication tokens
+// drift is not persisted and restarts from 0, a replayed total must get the same token
+func (t *totalRow) digest() hash.Hash {
+	h := sha256.New()
+	fmt.Fprintln(h, t.Round, t.Ts, t.Stake, t.MaxStake, t.StakeRwd, t.Onl, t.OnlRwd)
+	return h
+}
+
+// keyregDigest returns hash of keyreg rows for deduplication tokens
+func keyregDigest(rows []keyregRow) hash.Hash {
+	h := sha256.New()
+	for _, r := range rows {
+		fmt.Fprintln(h, r.Round, r.Addr, r.VoteFirst, r.VoteLast, r.KeyDilution, r.VotePK, r.SelectionPK, r.StateProofPK, r.NonParticipation, r.Fee, r.AuthAddr, r.AppID)
+	}
+	return h
+}
+
+// snapshotDigest returns hash of snapshot rows for deduplication tokens
+func snapshotDigest(rows []snapshotRow) hash.Hash {
+	h := sha256.New()
+	for _, r := range rows {
+		fmt.Fprintln(h, r.Addr, r.Round, r.Stake, r.SF)
+	}
+	return h
+}
+
+// eventDigest returns hash of event rows for deduplication tokens
+func eventDigest(rows []eventRow) hash.Hash {
+	h := sha256.New()
+	for _, r := range rows {
+		fmt.Fprintln(h, r.Addr, r.Round, r.Observed, r.OldState, r.NewState, r.Reason, r.StakeBefore, r.StakeAfter)
+	}
+	return h
+}
@@ -2,7 +2,9 @@ package exporter_onlch
 
 import (
 	"encoding/json"
+	"maps"
 	"math"
+	"sort"
 
 	"github.com/algorand/conduit/conduit/data"
 	"github.com/algorand/go-algorand-sdk/v2/types"
@@ -16,10 +18,16 @@ const (
 	Closed
 	Offlined
 	Expired
+	Suspended
+	// NotTracked is the event state of accounts not in the state table
+	NotTracked
 )
 
 const (
-	StakeLag = 320
+	StakeLag   = 320
+	RewardUnit = 1_000_000
+	// ExpiryWindow is the number of rounds after the last valid round a block header is expected to mark the account offline
+	ExpiryWindow = 32
 )
 
 func (s EXPReason) String() string {
@@ -32,39 +40,70 @@ func (s EXPReason) String() string {
 		return "offlined"
 	case Expired:
 		return "expired"
+	case Suspended:
+		return "suspended"
+	case NotTracked:
+		return "offline"
 	}
 	return "unknown"
 }
 
 type partAccount struct {
 	Addr          string           `json:"addr"`
+	VoteFirst     types.Round      `json:"votefirst,omitempty"`
 	VoteLast      types.Round      `json:"votelast"`
 	Stake         types.MicroAlgos `json:"stake"`
+	RewardsBase   uint64           `json:"rwdbase,omitempty"`
 	UpdatedAtRnd  types.Round      `json:"updated"`
+	Suspended     bool             `json:"suspended,omitempty"`
+	Unreg         bool             `json:"unreg,omitempty"`
+	HeaderExpired bool             `json:"hdrexpired,omitempty"`
 	AggSFSum      float64          `json:"aggsfsum"`
 	AggOnline     int32            `json:"aggonlrnd"`
+	AggStakeSum   float64          `json:"aggstakesum"`
+	AggProposals  int32            `json:"aggprop"`
+	AggPayout     types.MicroAlgos `json:"aggpayout"`
+	AggFees       types.MicroAlgos `json:"aggfees"`
+	SnapStake     types.MicroAlgos `json:"snapstake,omitempty"`
+	EvState       EXPReason        `json:"evstate,omitempty"`
+	EvStake       types.MicroAlgos `json:"evstake,omitempty"`
+	Tiers         []aggAccum       `json:"tiers,omitempty"`
 	stakeFraction float64
+	votingStake   types.MicroAlgos
 	state         EXPReason
 }
 
 type OnlineAccounts map[types.Address]*partAccount
 
 type onlineStakeState struct {
-	Accounts      OnlineAccounts   `json:"accounts"`
-	TotalStake    types.MicroAlgos `json:"totalstake"`
-	TotalStakeRwd types.MicroAlgos `json:"totalstakerwd"`
-	MaxStake      types.MicroAlgos `json:"maxstake"`
-	OnlineCnt     int              `json:"onlinecnt"`
-	OnlineCntRwd  int              `json:"onlinecntrwd"`
-	UpdatedAtRnd  types.Round      `json:"updated"`
-	NextExpiry    types.Round      `json:"nextexpiry"`
+	Accounts      OnlineAccounts         `json:"accounts"`
+	TotalStake    types.MicroAlgos       `json:"totalstake"`
+	TotalStakeRwd types.MicroAlgos       `json:"totalstakerwd"`
+	MaxStake      types.MicroAlgos       `json:"maxstake"`
+	OnlineCnt     int                    `json:"onlinecnt"`
+	OnlineCntRwd  int                    `json:"onlinecntrwd"`
+	UpdatedAtRnd  types.Round            `json:"updated"`
+	ProcessedRnd  types.Round            `json:"processed,omitempty"`
+	SentBinRnd    uint64                 `json:"sentbin,omitempty"`
+	NextExpiry    types.Round            `json:"nextexpiry"`
+	Unmarked      map[string]types.Round `json:"unmarked,omitempty"`
+	Periods       []periodBin            `json:"periods,omitempty"`
+	Protocol      string                 `json:"proto,omitempty"`
+	GenesisID     string                 `json:"genesisid,omitempty"`
+	GenesisHash   string                 `json:"genesishash,omitempty"`
 	lastRnd       types.Round
 	rewardsLevel  uint64
+	legacyRewards bool
 	aggBinSize    int64
+	tiers         []tierSpec
+	consensus     ConsensusParams
+	overrides     ConsensusTable
+	fallback      ConsensusParams
 	dirty         bool
 	log           *logrus.Logger
 	ip            data.InitProvider
 	debugAddr     *types.Address
+	events        []eventRow
 }
 
 func (i OnlineAccounts) MarshalJSON() ([]byte, error) {
@@ -97,25 +136,19 @@ func (onls *onlineStakeState) loadFromGenesis() {
 	onls.log.Infof("Loading genesis online state")
 	for _, ga := range gen.Allocation {
 		if ga.State.VoteLastValid > 0 && ga.State.Status == 1 {
+			vfv := types.Round(ga.State.VoteFirstValid)
 			vlv := types.Round(ga.State.VoteLastValid)
 			ma := types.MicroAlgos(ga.State.MicroAlgos)
 			addr, err := types.DecodeAddress(ga.Address)
 			if err == nil {
 				onls.log.WithFields(logrus.Fields{"round": 0}).Infof("Genesis stake for %s : %.1f", ga.Address, ma.ToAlgos())
-				onls.updateAccount(0, addr, &vlv, &ma)
+				onls.updateAccount(0, addr, &vfv, &vlv, &ma)
 			}
 		}
 	}
 	onls.dirty = true
 }
 
-func isEligible(ma types.MicroAlgos) bool {
-	if ma < 30000*1_000_000 || ma > types.MicroAlgos(math.Pow(2, 26)*1_000_000) {
-		return false
-	}
-	return true
-}
-
 // updateTotals recalculates stake fractions for accounts
 // also removes accounts that stopped voting from the state table
 func (onls *onlineStakeState) updateTotals(round types.Round) bool {
@@ -141,31 +174,44 @@ func (onls *onlineStakeState) updateTotals(round types.Round) bool {
 		if acc.VoteLast > 0 && acc.VoteLast < nextexpiry {
 			nextexpiry = acc.VoteLast + 1
 		}
+		// future dated registration starts counting at its first valid round
+		if acc.VoteFirst > round && acc.VoteFirst < nextexpiry {
+			nextexpiry = acc.VoteFirst
+		}
 		//move expiry to next update to persist the change
 		if acc.Stake == 0 {
 			acc.state = Closed
 		}
-		if acc.VoteLast >= round {
-			totalStake += acc.Stake
+		acc.votingStake = onls.effectiveStake(acc)
+		if acc.isVoting(round) {
+			totalStake += acc.votingStake
 			onlineCnt++
-			if acc.Stake > maxStake {
-				maxStake = acc.Stake
+			if acc.votingStake > maxStake {
+				maxStake = acc.votingStake
 			}
-			if isEligible(acc.Stake) {
+			if onls.isEligible(acc.votingStake) {
 				onlineCtnRwd++
-				totalStakeRwd += acc.Stake
+				totalStakeRwd += acc.votingStake
 			}
-		} else {
+		} else if acc.VoteLast < round {
 			acc.Stake = 0
-			if acc.VoteLast == 0 {
+			acc.votingStake = 0
+			if acc.Suspended {
+				acc.state = Suspended
+			} else if acc.Unreg || acc.VoteLast == 0 {
 				acc.state = Offlined
 			} else {
+				// ledger counts the account online until block header marks it offline
+				if acc.state != Expired && !acc.HeaderExpired {
+					onls.Unmarked[acc.Addr] = acc.VoteLast + types.Round(onls.lag())
+				}
 				acc.state = Expired
 			}
 		}
 		if acc.state != Online {
 			onls.log.WithFields(logrus.Fields{"round": round, "addr": acc.Addr}).Infof("Marking for deletion: %s", acc.state.String())
 		}
+		onls.trackTransition(round, acc)
 	}
 	onls.TotalStake = totalStake
 	onls.TotalStakeRwd = totalStakeRwd
@@ -178,7 +224,10 @@ func (onls *onlineStakeState) updateTotals(round types.Round) bool {
 
 	// update stake fractions for all accunts
 	for addr, acc := range onls.Accounts {
-		acc.stakeFraction = float64(acc.Stake) / float64(totalStake)
+		acc.stakeFraction = 0
+		if acc.isVoting(round) {
+			acc.stakeFraction = float64(acc.votingStake) / float64(totalStake)
+		}
 		if onls.debugAddr != nil && *onls.debugAddr == addr {
 			onls.log.WithFields(logrus.Fields{"round": round, "addr": acc.Addr}).Infof("lastVote:%d mAlgo:%d", acc.VoteLast, acc.Stake)
 		}
@@ -193,13 +242,18 @@ func (onls *onlineStakeState) updateTotals(round types.Round) bool {
 func (onls *onlineStakeState) resetAggregate(round types.Round) {
 	// remove all accounts marked for deletion in the previous pass
 	for addr, acct := range onls.Accounts {
+		acct.AggOnline = 0
+		acct.AggSFSum = 0
+		acct.AggStakeSum = 0
+		acct.AggProposals = 0
+		acct.AggPayout = 0
+		acct.AggFees = 0
 		// remove only if marked as not voting at the end of aggregation bin
-		if acct.state != Online {
+		// and not waiting for export in a longer tier
+		if acct.state != Online && onls.aggEmpty(acct) {
 			onls.log.WithFields(logrus.Fields{"round": round, "addr": acct.Addr}).Infof("Deleting account : %s", acct.state.String())
 			delete(onls.Accounts, addr)
 		}
-		acct.AggOnline = 0
-		acct.AggSFSum = 0
 	}
 }
 
@@ -207,33 +261,184 @@ func (onls *onlineStakeState) resetAggregate(round types.Round) {
 // returns true if the bin is full
 func (onls *onlineStakeState) updateAggregate(round types.Round) bool {
 	for _, acc := range onls.Accounts {
-		if acc.Stake > 0 {
+		if acc.Stake > 0 && acc.isVoting(round) {
 			acc.AggOnline++
 			acc.AggSFSum += acc.stakeFraction
+			acc.AggStakeSum += float64(acc.votingStake)
 		}
 	}
 	return int64(round)%onls.aggBinSize == onls.aggBinSize-1
 }
 
+// aggBinRound returns the lag shifted first round of the aggregate bin containing round
+func (onls *onlineStakeState) aggBinRound(round types.Round) uint64 {
+	rnd := uint64(round)
+	rnd -= rnd % uint64(onls.aggBinSize)
+	return rnd + onls.lag()
+}
+
+// sortedAccounts returns accounts ordered by address for deterministic exports
+func (onls *onlineStakeState) sortedAccounts() []*partAccount {
+	accts := make([]*partAccount, 0, len(onls.Accounts))
+	for _, acc := range onls.Accounts {
+		accts = append(accts, acc)
+	}
+	sort.Slice(accts, func(i, j int) bool { return accts[i].Addr < accts[j].Addr })
+	return accts
+}
+
+// updateProposer adds block proposer incentive payout to the current aggregate
+// proposals are not lag shifted - they are accounted in the bin of the round they were made
+func (onls *onlineStakeState) updateProposer(round types.Round, proposer types.Address, payout types.MicroAlgos, fees types.MicroAlgos) {
+	if proposer.IsZero() {
+		return
+	}
+	acct, exists := onls.Accounts[proposer]
+	if !exists {
+		// stake already removed from the lagged state, keep the account for this bin only
+		acct = &partAccount{
+			Addr:    proposer.String(),
+			state:   Offlined,
+			EvState: Offlined,
+		}
+		onls.Accounts[proposer] = acct
+	}
+	acct.AggProposals++
+	acct.AggPayout += payout
+	acct.AggFees += fees
+	for i := range onls.tierAccums(acct) {
+		acct.Tiers[i].Proposals++
+		acct.Tiers[i].Payout += payout
+		acct.Tiers[i].Fees += fees
+	}
+	onls.log.WithFields(logrus.Fields{"round": round, "addr": acct.Addr}).Infof("Proposer payout: %d fees: %d", payout, fees)
+}
+
+// payoutRatio returns payout to average stake ratio for the current aggregate bin
+func (acc *partAccount) payoutRatio() float64 {
+	if acc.AggOnline == 0 || acc.AggStakeSum == 0 {
+		return 0
+	}
+	return float64(acc.AggPayout) / (acc.AggStakeSum / float64(acc.AggOnline))
+}
+
 // updateAccountWithKeyreg updates state with key registration / unregistration (inner)transaction
 func (onls *onlineStakeState) updateAccountWithKeyreg(round types.Round, tx *types.SignedTxnWithAD) {
-	onls.updateAccount(round, tx.Txn.Sender, &tx.Txn.KeyregTxnFields.VoteLast, nil)
+	voteFirst := tx.Txn.KeyregTxnFields.VoteFirst
+	voteLast := tx.Txn.KeyregTxnFields.VoteLast
+	onls.updateAccount(round, tx.Txn.Sender, &voteFirst, &voteLast, nil)
 }
 
 // updateAccountWithAcctDelta updates state with account delta (state)
 func (onls *onlineStakeState) updateAccountWithAcctDelta(round types.Round, br *types.BalanceRecord) {
-	// MicroAlgos := br.AccountData.MicroAlgos
-	// if br.AccountData.Status != 2 {
-	// 	rewardsUnits := MicroAlgos / 1e6
-	// 	rewardsDelta := onls.rewardsLevel - br.AccountData.RewardsBase
-	// 	MicroAlgos += rewardsUnits * types.MicroAlgos(rewardsDelta)
-	// }
-	onls.updateAccount(round, br.Addr, nil, &br.AccountData.MicroAlgos)
+	// suspended accounts are marked offline by the protocol but keep their voting keys
+	if br.AccountData.Status == types.Offline && br.AccountData.VoteLastValid > 0 && !br.AccountData.IncentiveEligible {
+		onls.suspendAccount(round, br.Addr)
+	}
+	if br.AccountData.Status != types.Online {
+		delete(onls.Unmarked, br.Addr.String())
+	}
+	onls.updateAccount(round, br.Addr, nil, nil, &br.AccountData.MicroAlgos)
+	if acct, exists := onls.Accounts[br.Addr]; exists && acct.RewardsBase != br.AccountData.RewardsBase {
+		acct.RewardsBase = br.AccountData.RewardsBase
+		onls.dirty = onls.dirty || onls.legacyRewards
+	}
+}
+
+// updateRewardsLevel sets the legacy rewards level of the (lag shifted) round
+// pending rewards change voting stake of all accounts while rewards are distributed
+func (onls *onlineStakeState) updateRewardsLevel(level uint64) {
+	if onls.legacyRewards && onls.rewardsLevel != level {
+		onls.dirty = true
+	}
+	onls.rewardsLevel = level
+}
+
+// effectiveStake returns account stake including pending legacy participation rewards
+func (onls *onlineStakeState) effectiveStake(acc *partAccount) types.MicroAlgos {
+	if !onls.legacyRewards || onls.rewardsLevel <= acc.RewardsBase {
+		return acc.Stake
+	}
+	rewardsUnits := uint64(acc.Stake) / RewardUnit
+	return acc.Stake + types.MicroAlgos(rewardsUnits*(onls.rewardsLevel-acc.RewardsBase))
 }
 
-func (onls *onlineStakeState) updateAccount(round types.Round, addr types.Address, voteLast *types.Round, stake *types.MicroAlgos) {
+// trackTransition records state transition event of the account since the last totals update
+// accounts with future dated keys change state once they start voting
+func (onls *onlineStakeState) trackTransition(round types.Round, acc *partAccount) {
+	cur := acc.state
+	if cur == Online && !acc.isVoting(round) {
+		return
+	}
+	stake := acc.snapshotStake(round)
+	if cur != acc.EvState {
+		onls.events = append(onls.events, eventRow{
+			Addr:        acc.Addr,
+			Round:       uint64(round) + onls.lag(),
+			Observed:    uint64(round),
+			OldState:    acc.EvState.String(),
+			NewState:    cur.String(),
+			Reason:      acc.transitionReason(),
+			StakeBefore: int64(acc.EvStake),
+			StakeAfter:  int64(stake),
+		})
+	}
+	acc.EvState = cur
+	acc.EvStake = stake
+}
+
+// restore derives totals of loaded accounts in the round they were saved
+// transitions up to that round were tracked before the restart, later ones are tracked by the next update
+// expired accounts not yet marked by a header were recorded before the restart
+func (onls *onlineStakeState) restore() {
+	unmarked := maps.Clone(onls.Unmarked)
+	onls.dirty = true
+	onls.updateTotals(onls.UpdatedAtRnd)
+	onls.Unmarked = unmarked
+}
+
+// transitionReason returns what caused the current account state
+func (acc *partAccount) transitionReason() string {
+	switch acc.state {
+	case Online:
+		return "keyreg"
+	case Closed:
+		return "closeout"
+	case Offlined:
+		return "unregistered"
+	case Expired:
+		return "key_expired"
+	case Suspended:
+		return "absent"
+	}
+	return "unknown"
+}
+
+// snapshotStake returns stake exported in snapshots, 0 once the account stops voting
+func (acc *partAccount) snapshotStake(round types.Round) types.MicroAlgos {
+	if !acc.isVoting(round) {
+		return 0
+	}
+	return acc.votingStake
+}
+
+// isVoting returns true if account key is valid in the (lag shifted) round
+func (acc *partAccount) isVoting(round types.Round) bool {
+	return acc.VoteFirst <= round && acc.VoteLast >= round
+}
+
+// lagShift shifts key validity round by the stake lag
+func (onls *onlineStakeState) lagShift(rnd types.Round) types.Round {
+	if uint64(rnd) < onls.lag() {
+		return 0
+	}
+	return rnd - types.Round(onls.lag())
+}
+
+func (onls *onlineStakeState) updateAccount(round types.Round, addr types.Address, voteFirst *types.Round, voteLast *types.Round, stake *types.MicroAlgos) {
 	acct, exists := onls.Accounts[addr]
 	updated := false
+	unreg := false
 
 	if !exists && (voteLast == nil || *voteLast == 0) {
 		return
@@ -241,7 +446,8 @@ func (onls *onlineStakeState) updateAccount(round types.Round, addr types.Addres
 
 	if voteLast != nil && *voteLast < round {
 		if *voteLast == 0 {
-			*voteLast = round + StakeLag
+			*voteLast = round + types.Round(onls.lag())
+			unreg = true
 		} else {
 			return
 		}
@@ -249,7 +455,8 @@ func (onls *onlineStakeState) updateAccount(round types.Round, addr types.Addres
 
 	if !exists {
 		acct = &partAccount{
-			Addr: addr.String(),
+			Addr:    addr.String(),
+			EvState: NotTracked,
 		}
 		onls.Accounts[addr] = acct
 	}
@@ -261,12 +468,21 @@ func (onls *onlineStakeState) updateAccount(round types.Round, addr types.Addres
 	}
 
 	if voteLast != nil {
-		acct.VoteLast = *voteLast - StakeLag
+		acct.VoteLast = *voteLast - types.Round(onls.lag())
+		// the new key replaces the old one in the lagged state even if the old key is still valid
+		acct.VoteFirst = 0
+		if voteFirst != nil && acct.VoteLast > round {
+			acct.VoteFirst = onls.lagShift(*voteFirst)
+		}
+		acct.Suspended = false
+		acct.HeaderExpired = false
+		acct.Unreg = unreg
+		delete(onls.Unmarked, acct.Addr)
 		updated = true
 		if acct.VoteLast <= round {
 			onls.log.WithFields(logrus.Fields{"round": round, "addr": acct.Addr}).Infof("New voteLast: %d, unreg", acct.VoteLast)
 		} else {
-			onls.log.WithFields(logrus.Fields{"round": round, "addr": acct.Addr}).Infof("New voteLast: %d (%d)", acct.VoteLast, *voteLast)
+			onls.log.WithFields(logrus.Fields{"round": round, "addr": acct.Addr}).Infof("New voteFirst: %d voteLast: %d (%d)", acct.VoteFirst, acct.VoteLast, *voteLast)
 			acct.state = Online
 		}
 	}
@@ -275,3 +491,103 @@ func (onls *onlineStakeState) updateAccount(round types.Round, addr types.Addres
 		acct.UpdatedAtRnd = round
 	}
 }
+
+// suspendAccount marks account suspended by the protocol for absenteeism
+// suspension is lag shifted the same way as key unregistration
+func (onls *onlineStakeState) suspendAccount(round types.Round, addr types.Address) {
+	acct, exists := onls.Accounts[addr]
+	if !exists || acct.Suspended {
+		return
+	}
+	acct.Suspended = true
+	if acct.VoteLast > round {
+		acct.VoteLast = round
+	}
+	acct.UpdatedAtRnd = round
+	onls.dirty = true
+	onls.log.WithFields(logrus.Fields{"round": round, "addr": acct.Addr}).Infof("Suspended, voteLast: %d", acct.VoteLast)
+}
+
+// expireAccount applies protocol key expiry from the block header
+// returns true if the state did not expect the expiry
+func (onls *onlineStakeState) expireAccount(round types.Round, addr types.Address) bool {
+	_, expected := onls.Unmarked[addr.String()]
+	if expected {
+		delete(onls.Unmarked, addr.String())
+		return false
+	}
+	acct, exists := onls.Accounts[addr]
+	if !exists {
+		onls.log.WithFields(logrus.Fields{"round": round, "addr": addr.String()}).Warnf("Expired by header, not in state")
+		return true
+	}
+	// already removed by the heuristic
+	if acct.VoteLast < round {
+		return false
+	}
+	onls.log.WithFields(logrus.Fields{"round": round, "addr": acct.Addr}).Warnf("Expired by header, heuristic voteLast: %d", acct.VoteLast)
+	// same as suspension the account is still counted in the round it is marked offline
+	acct.VoteLast = round
+	acct.HeaderExpired = true
+	acct.UpdatedAtRnd = round
+	onls.dirty = true
+	return true
+}
+
+// applyParticipationUpdates applies block header expired and absent account lists
+// returns number of header updates that disagree with the state
+func (onls *onlineStakeState) applyParticipationUpdates(round types.Round, pu *types.ParticipationUpdates) int {
+	mismatches := 0
+	for _, addr := range pu.ExpiredParticipationAccounts {
+		if onls.expireAccount(round, addr) {
+			mismatches++
+		}
+	}
+	for _, addr := range pu.AbsentParticipationAccounts {
+		// absent accounts are online in the ledger
+		if _, exists := onls.Accounts[addr]; !exists {
+			if _, expected := onls.Unmarked[addr.String()]; !expected {
+				onls.log.WithFields(logrus.Fields{"round": round, "addr": addr.String()}).Warnf("Absent by header, not in state")
+				mismatches++
+			}
+		}
+		onls.suspendAccount(round, addr)
+	}
+	mismatches += onls.pruneUnmarked(round)
+	return mismatches
+}
+
+// pruneUnmarked removes expired accounts the block header should have marked offline by round
+// returns number of accounts the header did not mark in time
+func (onls *onlineStakeState) pruneUnmarked(round types.Round) int {
+	missed := 0
+	for addr, rnd := range onls.Unmarked {
+		if rnd+ExpiryWindow < round {
+			if onls.consensus.expiries {
+				onls.log.WithFields(logrus.Fields{"round": round, "addr": addr}).Warnf("Not marked offline by header since round %d", rnd)
+				missed++
+			}
+			delete(onls.Unmarked, addr)
+		}
+	}
+	return missed
+}
+
+// isComparable returns true if TotalStake should match ledger online money in the round
+// ledger counts accounts by status while plugin counts them by lag shifted key validity
+func (onls *onlineStakeState) isComparable(round types.Round) bool {
+	if len(onls.Unmarked) > 0 {
+		return false
+	}
+	for _, acc := range onls.Accounts {
+		// future dated keys are already online in the ledger
+		if acc.VoteFirst > round && acc.VoteLast >= round {
+			return false
+		}
+		// unregistered and header marked accounts are still counted in the round of the event
+		if (acc.Unreg || acc.Suspended || acc.HeaderExpired) && acc.VoteLast >= round {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,332 @@
+package exporter_onlch
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/algorand/go-algorand-sdk/v2/types"
+)
+
+const testStake = types.MicroAlgos(100_000 * RewardUnit)
+
+var (
+	addrA = types.Address{1}
+	addrB = types.Address{2}
+)
+
+// makeTestState returns empty state with default consensus parameters (320 rounds lag)
+func makeTestState() *onlineStakeState {
+	return &onlineStakeState{
+		Accounts:   make(OnlineAccounts),
+		NextExpiry: math.MaxInt64,
+		Unmarked:   make(map[string]types.Round),
+		consensus:  defaultConsensus,
+		dirty:      true,
+		log:        testLogger(),
+	}
+}
+
+// reloadState saves state and loads it back the way a restart does
+func reloadState(t *testing.T, onls *onlineStakeState) *onlineStakeState {
+	content, err := json.Marshal(onls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := makeTestState()
+	if err := json.Unmarshal(content, loaded); err != nil {
+		t.Fatal(err)
+	}
+	loaded.restore()
+	// transitions seen while loading were exported before the restart
+	loaded.events = nil
+	return loaded
+}
+
+func TestUpdateAccount(t *testing.T) {
+	tests := []struct {
+		name      string
+		acct      *partAccount
+		unmarked  bool
+		voteFirst types.Round
+		voteLast  types.Round
+		expected  *partAccount
+		voting    bool
+	}{
+		{
+			name:      "new key",
+			voteFirst: 900,
+			voteLast:  5000,
+			expected:  &partAccount{VoteFirst: 580, VoteLast: 4680},
+			voting:    true,
+		},
+		{
+			name:      "future dated key",
+			voteFirst: 2000,
+			voteLast:  5000,
+			expected:  &partAccount{VoteFirst: 1680, VoteLast: 4680},
+		},
+		{
+			name:      "expired key",
+			voteFirst: 100,
+			voteLast:  900,
+		},
+		{
+			name: "unregistration of unknown account",
+		},
+		{
+			name:     "unregistration",
+			acct:     &partAccount{VoteFirst: 580, VoteLast: 4680},
+			expected: &partAccount{VoteLast: 1000, Unreg: true},
+			voting:   true,
+		},
+		{
+			name:      "re-registration",
+			acct:      &partAccount{VoteLast: 900, Unreg: true},
+			voteFirst: 1000,
+			voteLast:  5000,
+			expected:  &partAccount{VoteFirst: 680, VoteLast: 4680},
+			voting:    true,
+		},
+		{
+			name:      "re-registration of suspended account",
+			acct:      &partAccount{VoteLast: 900, Suspended: true},
+			unmarked:  true,
+			voteFirst: 1000,
+			voteLast:  5000,
+			expected:  &partAccount{VoteFirst: 680, VoteLast: 4680},
+			voting:    true,
+		},
+		{
+			name:      "re-keying while the old key is still valid",
+			acct:      &partAccount{VoteFirst: 580, VoteLast: 4680},
+			voteFirst: 1500,
+			voteLast:  9000,
+			expected:  &partAccount{VoteFirst: 1180, VoteLast: 8680},
+		},
+		{
+			name:      "re-keying with the next key already valid",
+			acct:      &partAccount{VoteFirst: 580, VoteLast: 4680},
+			voteFirst: 1000,
+			voteLast:  9000,
+			expected:  &partAccount{VoteFirst: 680, VoteLast: 8680},
+			voting:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			onls := makeTestState()
+			if tt.acct != nil {
+				tt.acct.Addr = addrA.String()
+				tt.acct.Stake = testStake
+				onls.Accounts[addrA] = tt.acct
+			}
+			if tt.unmarked {
+				onls.Unmarked[addrA.String()] = 1220
+			}
+			voteFirst, voteLast, stake := tt.voteFirst, tt.voteLast, testStake
+			onls.updateAccount(1000, addrA, &voteFirst, &voteLast, &stake)
+
+			acct, exists := onls.Accounts[addrA]
+			if tt.expected == nil {
+				if exists {
+					t.Fatalf("account tracked with votefirst %d votelast %d", acct.VoteFirst, acct.VoteLast)
+				}
+				return
+			}
+			if !exists {
+				t.Fatal("account not tracked")
+			}
+			if acct.VoteFirst != tt.expected.VoteFirst || acct.VoteLast != tt.expected.VoteLast {
+				t.Errorf("votefirst %d votelast %d, expected %d %d", acct.VoteFirst, acct.VoteLast, tt.expected.VoteFirst, tt.expected.VoteLast)
+			}
+			if acct.Unreg != tt.expected.Unreg || acct.Suspended != tt.expected.Suspended {
+				t.Errorf("unreg %t suspended %t, expected %t %t", acct.Unreg, acct.Suspended, tt.expected.Unreg, tt.expected.Suspended)
+			}
+			if acct.isVoting(1000) != tt.voting {
+				t.Errorf("voting %t, expected %t", acct.isVoting(1000), tt.voting)
+			}
+			if _, unmarked := onls.Unmarked[addrA.String()]; unmarked {
+				t.Error("registered account still expected to be marked offline")
+			}
+		})
+	}
+}
+
+func TestParticipationUpdates(t *testing.T) {
+	tests := []struct {
+		name       string
+		acct       *partAccount
+		unmarked   types.Round
+		noExpiries bool
+		expired    []types.Address
+		absent     []types.Address
+		mismatches int
+		voteLast   types.Round
+		comparable bool
+		pending    int
+	}{
+		{
+			name:       "expected expiry",
+			unmarked:   990,
+			expired:    []types.Address{addrA},
+			comparable: true,
+		},
+		{
+			name:       "expiry of unknown account",
+			expired:    []types.Address{addrB},
+			mismatches: 1,
+			comparable: true,
+		},
+		{
+			name:       "early expiry",
+			acct:       &partAccount{VoteLast: 4680},
+			expired:    []types.Address{addrA},
+			mismatches: 1,
+			voteLast:   1000,
+		},
+		{
+			name:     "expected suspension",
+			acct:     &partAccount{VoteLast: 4680},
+			absent:   []types.Address{addrA},
+			voteLast: 1000,
+		},
+		{
+			name:       "suspension of unknown account",
+			absent:     []types.Address{addrB},
+			mismatches: 1,
+			comparable: true,
+		},
+		{
+			name:     "expiry not yet marked",
+			unmarked: 990,
+			pending:  1,
+		},
+		{
+			name:       "expiry never marked",
+			unmarked:   960,
+			mismatches: 1,
+			comparable: true,
+		},
+		{
+			name:       "expiry never marked without header expirations",
+			unmarked:   960,
+			noExpiries: true,
+			comparable: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			onls := makeTestState()
+			onls.consensus.expiries = !tt.noExpiries
+			if tt.acct != nil {
+				tt.acct.Addr = addrA.String()
+				tt.acct.Stake = testStake
+				onls.Accounts[addrA] = tt.acct
+			}
+			if tt.unmarked > 0 {
+				onls.Unmarked[addrA.String()] = tt.unmarked
+			}
+			pu := &types.ParticipationUpdates{ExpiredParticipationAccounts: tt.expired, AbsentParticipationAccounts: tt.absent}
+			if mismatches := onls.applyParticipationUpdates(1000, pu); mismatches != tt.mismatches {
+				t.Errorf("%d mismatches, expected %d", mismatches, tt.mismatches)
+			}
+			if acct, exists := onls.Accounts[addrA]; exists && acct.VoteLast != tt.voteLast {
+				t.Errorf("votelast %d, expected %d", acct.VoteLast, tt.voteLast)
+			}
+			// accounts marked offline in the round are still counted in it
+			if onls.isComparable(1000) != tt.comparable {
+				t.Errorf("comparable %t, expected %t", onls.isComparable(1000), tt.comparable)
+			}
+			// marked accounts are not expected to be marked again
+			onls.updateTotals(1001)
+			if len(onls.Unmarked) != tt.pending {
+				t.Errorf("%d accounts expected to be marked offline, expected %d", len(onls.Unmarked), tt.pending)
+			}
+		})
+	}
+}
+
+func TestTransitionsAcrossReload(t *testing.T) {
+	type keyreg struct {
+		round     types.Round
+		voteFirst types.Round
+		voteLast  types.Round
+	}
+	tests := []struct {
+		name     string
+		keyregs  []keyreg
+		reload   types.Round
+		until    types.Round
+		expected []string
+	}{
+		{
+			name:     "future dated key starts voting",
+			keyregs:  []keyreg{{1000, 2000, 5000}},
+			reload:   1200,
+			until:    1700,
+			expected: []string{"offline>online@2000"},
+		},
+		{
+			name:     "key expires",
+			keyregs:  []keyreg{{1000, 900, 1500}},
+			reload:   1100,
+			until:    1200,
+			expected: []string{"offline>online@1320", "online>expired@1501"},
+		},
+		{
+			name:     "key expires in the round after reload",
+			keyregs:  []keyreg{{1000, 900, 1500}},
+			reload:   1180,
+			until:    1200,
+			expected: []string{"offline>online@1320", "online>expired@1501"},
+		},
+		{
+			name:     "key unregistered",
+			keyregs:  []keyreg{{1000, 900, 5000}, {1100, 0, 0}},
+			reload:   1050,
+			until:    1200,
+			expected: []string{"offline>online@1320", "online>offlined@1421"},
+		},
+		{
+			name:     "re-keyed with future dated key",
+			keyregs:  []keyreg{{1000, 900, 5000}, {1100, 1500, 9000}},
+			reload:   1120,
+			until:    1200,
+			expected: []string{"offline>online@1320"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// events of a run with and without restart are the same
+			for _, reload := range []types.Round{0, tt.reload} {
+				onls := makeTestState()
+				var events []string
+				for rnd := types.Round(1000); rnd <= tt.until; rnd++ {
+					for _, kr := range tt.keyregs {
+						if kr.round == rnd {
+							voteFirst, voteLast, stake := kr.voteFirst, kr.voteLast, testStake
+							onls.updateAccount(rnd, addrA, &voteFirst, &voteLast, &stake)
+						}
+					}
+					onls.updateTotals(rnd)
+					for _, e := range onls.events {
+						if e.StakeBefore+e.StakeAfter != int64(testStake) {
+							t.Errorf("event %s>%s stake %d to %d", e.OldState, e.NewState, e.StakeBefore, e.StakeAfter)
+						}
+						events = append(events, e.OldState+">"+e.NewState+"@"+fmt.Sprint(e.Round))
+					}
+					onls.events = nil
+					if rnd == reload {
+						onls = reloadState(t, onls)
+					}
+				}
+				if !slices.Equal(events, tt.expected) {
+					t.Errorf("reload at %d: events %v, expected %v", reload, events, tt.expected)
+				}
+			}
+		})
+	}
+}
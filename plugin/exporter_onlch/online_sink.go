@@ -0,0 +1,276 @@
+package exporter_onlch
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/algorand/go-algorand-sdk/v2/types"
+)
+
+const (
+	SinkClickHouse = "clickhouse"
+	SinkPostgres   = "postgres"
+	SinkSQLite     = "sqlite"
+)
+
+const (
+	ReconcileRefuse = "refuse"
+	ReconcileRepair = "repair"
+	ReconcileOff    = "off"
+)
+
+// Sink is an output of exported rows
+// tables are named by the exporter config, rounds are lag shifted like in exported rows
+type Sink interface {
+	Name() string
+	SendAggregates(bins []*aggregateBin) error
+	SendTotal(t *totalRow) error
+	SendKeyregs(rows []keyregRow) error
+	SendSnapshot(rows []snapshotRow) error
+	SendEvents(rows []eventRow) error
+	// MaxRound returns the highest exported round of the table and false if it is empty
+	MaxRound(table string) (uint64, bool, error)
+	DeleteAfter(table string, rnd uint64) error
+	Truncate(table string) error
+	SetTTL(table string, ttl string) error
+	Close() error
+}
+
+// MakeSinks instantiates configured sinks, ClickHouse if none configured
+func (oe *onlineExporter) MakeSinks() ([]Sink, error) {
+	names := oe.cfg.Sinks
+	if len(names) == 0 {
+		names = []string{SinkClickHouse}
+	}
+	var sinks []Sink
+	for i, name := range names {
+		if slices.Contains(names[:i], name) {
+			return nil, fmt.Errorf("sink %q configured twice", name)
+		}
+		switch name {
+		case SinkClickHouse:
+			ch, err := oe.MakeClickHouseSink()
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, ch)
+		case SinkPostgres:
+			pg, err := oe.MakePostgresSink()
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, pg)
+		case SinkSQLite:
+			sq, err := oe.MakeSQLiteSink()
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sq)
+		default:
+			return nil, fmt.Errorf("unknown sink %q", name)
+		}
+	}
+	return sinks, nil
+}
+
+// closeSinks closes all sinks, returns the first error
+func (oe *onlineExporter) closeSinks() error {
+	var first error
+	for _, s := range oe.sinks {
+		if err := s.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// sendTo inserts spool entry into sink
+func sendTo(s Sink, e *spoolEntry) error {
+	if len(e.Aggregates) > 0 {
+		if err := s.SendAggregates(e.Aggregates); err != nil {
+			return err
+		}
+	}
+	if e.Total != nil {
+		if err := s.SendTotal(e.Total); err != nil {
+			return err
+		}
+	}
+	if len(e.Keyregs) > 0 {
+		if err := s.SendKeyregs(e.Keyregs); err != nil {
+			return err
+		}
+	}
+	if len(e.Snapshot) > 0 {
+		if err := s.SendSnapshot(e.Snapshot); err != nil {
+			return err
+		}
+	}
+	if len(e.Events) > 0 {
+		if err := s.SendEvents(e.Events); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send inserts spool entry into all sinks in order
+// sinks that already got the entry are recorded in it and skipped when it is replayed
+func (oe *onlineExporter) send(e *spoolEntry) error {
+	for _, s := range oe.sinks {
+		if slices.Contains(e.Sent, s.Name()) {
+			continue
+		}
+		if err := sendTo(s, e); err != nil {
+			return fmt.Errorf("%s: %w", s.Name(), err)
+		}
+		if len(oe.sinks) > 1 {
+			e.Sent = append(e.Sent, s.Name())
+		}
+	}
+	return nil
+}
+
+// lastBinRound returns the lag shifted round of the last aggregate bin exported before nextRound
+func (oe *onlineExporter) lastBinRound(nextRound types.Round) (uint64, bool) {
+	bin := uint64(oe.cfg.ChAggBin)
+	if nextRound == 0 {
+		return 0, false
+	}
+	// genesis bins are exported on startup from round 0
+	lag := oe.onls.lag()
+	last := (lag - 1) - (lag-1)%bin
+	if uint64(nextRound) >= bin {
+		if r := (uint64(nextRound)/bin-1)*bin + lag; r > last {
+			last = r
+		}
+	}
+	return last, true
+}
+
+// reconcile compares exported rounds of every sink with the pipeline round
+// rows exported after the pipeline round are deleted in repair mode and re-exported while processing
+func (oe *onlineExporter) reconcile(nextRound types.Round) error {
+	mode := oe.cfg.Reconcile
+	if mode == "" {
+		mode = ReconcileRefuse
+	}
+	switch mode {
+	case ReconcileOff:
+		return nil
+	case ReconcileRefuse, ReconcileRepair:
+	default:
+		return fmt.Errorf("unknown reconcile mode %q", mode)
+	}
+	if oe.isDebugRun() {
+		return nil
+	}
+
+	// sparse tables are not exported every bin and cannot be checked for gaps
+	type check struct {
+		table  string
+		last   uint64
+		ok     bool
+		sparse bool
+	}
+	var checks []check
+	binRnd, binOk := oe.lastBinRound(nextRound)
+	if oe.cfg.AggTab != "" {
+		checks = append(checks, check{oe.cfg.AggTab, binRnd, binOk, false})
+	}
+	if oe.cfg.TotalTab != "" {
+		checks = append(checks, check{oe.cfg.TotalTab, binRnd, binOk, false})
+	}
+	for _, t := range oe.cfg.Tiers {
+		if t.Period != "" {
+			// wall clock bins start at the first round of the period
+			checks = append(checks, check{t.Table, uint64(nextRound) - 1 + oe.onls.lag(), nextRound > 0, true})
+			continue
+		}
+		// tier bins are aligned on lag shifted rounds and include genesis rounds
+		lNext := uint64(nextRound) + oe.onls.lag()
+		checks = append(checks, check{t.Table, lNext/uint64(t.Bin)*uint64(t.Bin) - uint64(t.Bin), nextRound > 0 && lNext >= uint64(t.Bin), false})
+	}
+	if oe.cfg.SnapshotTab != "" {
+		checks = append(checks, check{oe.cfg.SnapshotTab, uint64(nextRound) - 1 + oe.onls.lag(), nextRound > 0, true})
+	}
+	if oe.cfg.EventTab != "" {
+		checks = append(checks, check{oe.cfg.EventTab, uint64(nextRound) - 1 + oe.onls.lag(), nextRound > 0, true})
+	}
+	if oe.cfg.KeyregTab != "" {
+		// keyregs are exported with their own round
+		checks = append(checks, check{oe.cfg.KeyregTab, uint64(nextRound) - 1, nextRound > 0, true})
+	}
+
+	for _, s := range oe.sinks {
+		for _, c := range checks {
+			maxRnd, exists, sErr := s.MaxRound(c.table)
+			if sErr != nil && oe.spool == nil {
+				return sErr
+			}
+			// spooled rows are not in the sink yet
+			if sRnd, sExists := oe.spoolMaxRound(s.Name(), c.table); sExists {
+				maxRnd, exists = max(maxRnd, sRnd), true
+			}
+			report := fmt.Sprintf("%s table %s max round %d, expected %d (nextDBRound %d, state updated %d, processed %d)",
+				s.Name(), c.table, maxRnd, c.last, nextRound, oe.onls.UpdatedAtRnd, oe.onls.ProcessedRnd)
+			switch {
+			case exists && (!c.ok || maxRnd > c.last) && oe.resumed && oe.cfg.ChDedup:
+				// rows of rounds processed again are dropped by deduplication, deleted rows would be dropped too
+				oe.log.Infof("Keeping deduplicated %s", report)
+			case exists && (!c.ok || maxRnd > c.last):
+				// rows after the saved state or a checkpoint are exported again
+				if mode == ReconcileRefuse && !oe.resumed {
+					return fmt.Errorf("rows exported after pipeline round, %s", report)
+				}
+				oe.log.Warnf("Reconciling %s", report)
+				if err := oe.spoolDropAfter(c.table, c.last); err != nil {
+					return err
+				}
+				if sErr != nil {
+					continue
+				}
+				if !c.ok {
+					// starting from genesis, nothing was exported yet
+					if err := s.Truncate(c.table); err != nil {
+						return err
+					}
+				} else if err := s.DeleteAfter(c.table, c.last); err != nil {
+					return err
+				}
+			case sErr != nil:
+				oe.log.Warnf("Skipping reconcile of %s %s: %v", s.Name(), c.table, sErr)
+			case c.ok && !exists && !c.sparse:
+				// table added to an existing deployment starts with the current bin
+				oe.log.Infof("New %s", report)
+			case c.ok && maxRnd < c.last && !c.sparse:
+				return fmt.Errorf("rows missing before pipeline round, rewind to a checkpoint to re-export, %s", report)
+			default:
+				oe.log.Infof("Reconciled %s", report)
+			}
+		}
+	}
+	return nil
+}
+
+// setTierTTL sets TTL of tier tables in every sink
+func (oe *onlineExporter) setTierTTL() error {
+	if oe.isDebugRun() {
+		return nil
+	}
+	for _, t := range oe.cfg.Tiers {
+		if t.TTL == "" {
+			continue
+		}
+		for _, s := range oe.sinks {
+			oe.log.Infof("Setting TTL of %s %s to %s", s.Name(), t.Table, t.TTL)
+			err := s.SetTTL(t.Table, t.TTL)
+			if err != nil && oe.spool != nil {
+				oe.log.Warnf("Skipping TTL of %s %s: %v", s.Name(), t.Table, err)
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package exporter_onlch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		name     string
+		sent     []uint64
+		resumed  bool
+		dedup    bool
+		hwmRound uint64
+		err      string
+	}{
+		{name: "in sync", sent: []uint64{1300, 1310}, hwmRound: 1310},
+		{name: "new table"},
+		{name: "rows after pipeline round", sent: []uint64{1310, 1320}, err: "rows exported after pipeline round"},
+		{name: "rows after saved state", sent: []uint64{1310, 1320}, resumed: true, hwmRound: 1310},
+		{name: "deduplicated rows after saved state", sent: []uint64{1310, 1320}, resumed: true, dedup: true, hwmRound: 1320},
+		{name: "rows missing", sent: []uint64{1300}, resumed: true, err: "rows missing before pipeline round"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sq := makeTestSQLite(t)
+			var bins []*aggregateBin
+			for _, rnd := range tt.sent {
+				bins = append(bins, testBin(rnd, 10))
+			}
+			if err := sq.SendAggregates(bins); err != nil {
+				t.Fatal(err)
+			}
+			oe := &onlineExporter{log: testLogger(), sinks: []Sink{sq}, onls: &onlineStakeState{}, resumed: tt.resumed}
+			oe.cfg.AggTab = sq.cfg.AggTab
+			oe.cfg.ChAggBin = 10
+			oe.cfg.ChDedup = tt.dedup
+			// the last bin before round 1000 is lag shifted to 1310
+			err := oe.reconcile(1000)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			rnd, _, err := sq.MaxRound(sq.cfg.AggTab)
+			if err != nil || rnd != tt.hwmRound {
+				t.Errorf("high-water mark %d %v, expected %d", rnd, err, tt.hwmRound)
+			}
+		})
+	}
+}
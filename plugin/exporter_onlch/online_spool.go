@@ -0,0 +1,320 @@
+package exporter_onlch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	spoolMinBackoff = time.Second
+	spoolMaxBackoff = 5 * time.Minute
+)
+
+// spoolEntry is a single export that could not be sent
+type spoolEntry struct {
+	Spooled    int64           `json:"spooled"`
+	Aggregates []*aggregateBin `json:"aggregates,omitempty"`
+	Total      *totalRow       `json:"total,omitempty"`
+	Keyregs    []keyregRow     `json:"keyregs,omitempty"`
+	Snapshot   []snapshotRow   `json:"snapshot,omitempty"`
+	Events     []eventRow      `json:"events,omitempty"`
+	Sent       []string        `json:"sent,omitempty"`
+}
+
+// exportSpool is a disk backed write-ahead buffer of exports waiting for sinks
+// entries are stored as JSON lines and replayed in order
+type exportSpool struct {
+	fName   string
+	entries []*spoolEntry
+	size    int
+	backoff time.Duration
+	nextTry time.Time
+	log     *logrus.Logger
+}
+
+// MakeSpool loads spooled exports from the datadir
+func (oe *onlineExporter) MakeSpool(fName string) (*exportSpool, error) {
+	sp := &exportSpool{
+		fName: fName,
+		log:   oe.log,
+	}
+	content, err := os.ReadFile(fName)
+	if errors.Is(err, os.ErrNotExist) {
+		return sp, nil
+	} else if err != nil {
+		return nil, err
+	}
+	lines := bytes.Split(content, []byte{'\n'})
+	// the file ends with a newline unless the last write was torn
+	last := len(lines) - 1
+	for last >= 0 && len(lines[last]) == 0 {
+		last--
+	}
+	torn := false
+	for i, line := range lines[:last+1] {
+		if len(line) == 0 {
+			continue
+		}
+		e := &spoolEntry{}
+		if err := json.Unmarshal(line, e); err != nil {
+			if i < last {
+				return nil, fmt.Errorf("corrupted spool %s at line %d: %w", fName, i+1, err)
+			}
+			// torn write of the last entry, it was never acknowledged
+			sp.log.Warnf("Dropping torn spool entry: %v", err)
+			torn = true
+			continue
+		}
+		sp.entries = append(sp.entries, e)
+		sp.size += len(line) + 1
+	}
+	// entries appended later must not follow the torn line
+	if torn {
+		if err := sp.rewrite(); err != nil {
+			return nil, err
+		}
+	}
+	if len(sp.entries) > 0 {
+		sp.log.Warnf("Loaded %d spooled exports", len(sp.entries))
+	}
+	sp.updateMetrics()
+	return sp, nil
+}
+
+// append durably appends entry to the spool file
+func (sp *exportSpool) append(e *spoolEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	f, err := os.OpenFile(sp.fName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	sp.entries = append(sp.entries, e)
+	sp.size += len(line)
+	sp.updateMetrics()
+	return nil
+}
+
+// trim removes first n entries that were sent
+func (sp *exportSpool) trim(n int) error {
+	sp.entries = sp.entries[n:]
+	return sp.rewrite()
+}
+
+// rewrite atomically replaces the spool file with pending entries
+func (sp *exportSpool) rewrite() error {
+	defer sp.updateMetrics()
+	if len(sp.entries) == 0 {
+		sp.size = 0
+		sp.backoff = 0
+		if err := os.Remove(sp.fName); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, e := range sp.entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	sp.size = buf.Len()
+	return writeFileAtomic(sp.fName, buf.Bytes())
+}
+
+// fail schedules next replay with exponential backoff
+func (sp *exportSpool) fail() {
+	if sp.backoff == 0 {
+		sp.backoff = spoolMinBackoff
+	} else if sp.backoff *= 2; sp.backoff > spoolMaxBackoff {
+		sp.backoff = spoolMaxBackoff
+	}
+	sp.nextTry = time.Now().Add(sp.backoff)
+}
+
+// age returns time since the oldest entry was spooled
+func (sp *exportSpool) age() time.Duration {
+	if len(sp.entries) == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(sp.entries[0].Spooled, 0))
+}
+
+func (sp *exportSpool) updateMetrics() {
+	spoolEntries.Set(float64(len(sp.entries)))
+	spoolBytes.Set(float64(sp.size))
+	spoolAgeSeconds.Set(sp.age().Seconds())
+}
+
+// export sends entry to sinks or spools it if a sink is not available
+// entries are spooled behind any pending ones to keep export order
+func (oe *onlineExporter) export(e *spoolEntry) error {
+	sp := oe.spool
+	if sp == nil {
+		return oe.send(e)
+	}
+	if len(sp.entries) == 0 {
+		err := oe.send(e)
+		if err == nil {
+			return nil
+		}
+		oe.log.Warnf("Spooling export: %v", err)
+		sp.fail()
+	}
+	e.Spooled = time.Now().Unix()
+	if err := sp.append(e); err != nil {
+		return err
+	}
+	return oe.replaySpool(false)
+}
+
+// replaySpool sends spooled entries in order until the first failure
+// force ignores the backoff
+func (oe *onlineExporter) replaySpool(force bool) error {
+	sp := oe.spool
+	if sp == nil || len(sp.entries) == 0 {
+		return nil
+	}
+	defer sp.updateMetrics()
+	if !force && time.Now().Before(sp.nextTry) {
+		return nil
+	}
+	sent := 0
+	for _, e := range sp.entries {
+		partial := len(e.Sent)
+		if err := oe.send(e); err != nil {
+			sp.fail()
+			// keep sinks that got the entry across restarts
+			if len(e.Sent) > partial {
+				if err := sp.rewrite(); err != nil {
+					return err
+				}
+			}
+			oe.log.Warnf("Spool replay failed, %d exports pending for %s, next try in %s: %v", len(sp.entries)-sent, sp.age().Truncate(time.Second), sp.backoff, err)
+			break
+		}
+		sent++
+	}
+	if sent == 0 {
+		return nil
+	}
+	oe.log.Infof("Replayed %d spooled exports", sent)
+	return sp.trim(sent)
+}
+
+// spoolMaxRound returns the highest round spooled for the table of sink
+func (oe *onlineExporter) spoolMaxRound(sink string, table string) (uint64, bool) {
+	var (
+		rnd    uint64
+		exists bool
+	)
+	if oe.spool == nil {
+		return 0, false
+	}
+	for _, e := range oe.spool.entries {
+		if slices.Contains(e.Sent, sink) {
+			continue
+		}
+		for _, bin := range e.Aggregates {
+			if oe.cfg.binTable(bin) == table {
+				rnd, exists = max(rnd, bin.Round), true
+			}
+		}
+		if table == oe.cfg.TotalTab && e.Total != nil {
+			rnd, exists = max(rnd, e.Total.Round), true
+		}
+		if table == oe.cfg.KeyregTab {
+			for _, k := range e.Keyregs {
+				rnd, exists = max(rnd, k.Round), true
+			}
+		}
+		if table == oe.cfg.SnapshotTab {
+			for _, r := range e.Snapshot {
+				rnd, exists = max(rnd, r.Round), true
+			}
+		}
+		if table == oe.cfg.EventTab {
+			for _, r := range e.Events {
+				rnd, exists = max(rnd, r.Round), true
+			}
+		}
+	}
+	return rnd, exists
+}
+
+// spoolDropAfter removes rows after round for the table from spooled entries
+func (oe *onlineExporter) spoolDropAfter(table string, rnd uint64) error {
+	sp := oe.spool
+	if sp == nil {
+		return nil
+	}
+	var entries []*spoolEntry
+	for _, e := range sp.entries {
+		var bins []*aggregateBin
+		for _, bin := range e.Aggregates {
+			if oe.cfg.binTable(bin) != table || bin.Round <= rnd {
+				bins = append(bins, bin)
+			}
+		}
+		e.Aggregates = bins
+		if table == oe.cfg.TotalTab && e.Total != nil && e.Total.Round > rnd {
+			e.Total = nil
+		}
+		if table == oe.cfg.KeyregTab {
+			var rows []keyregRow
+			for _, k := range e.Keyregs {
+				if k.Round <= rnd {
+					rows = append(rows, k)
+				}
+			}
+			e.Keyregs = rows
+		}
+		if table == oe.cfg.SnapshotTab {
+			var rows []snapshotRow
+			for _, r := range e.Snapshot {
+				if r.Round <= rnd {
+					rows = append(rows, r)
+				}
+			}
+			e.Snapshot = rows
+		}
+		if table == oe.cfg.EventTab {
+			var rows []eventRow
+			for _, r := range e.Events {
+				if r.Round <= rnd {
+					rows = append(rows, r)
+				}
+			}
+			e.Events = rows
+		}
+		if len(e.Aggregates) > 0 || e.Total != nil || len(e.Keyregs) > 0 || len(e.Snapshot) > 0 || len(e.Events) > 0 {
+			entries = append(entries, e)
+		}
+	}
+	sp.entries = entries
+	return sp.rewrite()
+}
@@ -0,0 +1,167 @@
+package exporter_onlch
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testSink records sent totals and fails while fail is set or from the failAt-th total on
+type testSink struct {
+	rounds []uint64
+	fail   bool
+	failAt int
+}
+
+func (s *testSink) Name() string                          { return "test" }
+func (s *testSink) SendAggregates([]*aggregateBin) error  { return nil }
+func (s *testSink) SendKeyregs([]keyregRow) error         { return nil }
+func (s *testSink) SendSnapshot([]snapshotRow) error      { return nil }
+func (s *testSink) SendEvents([]eventRow) error           { return nil }
+func (s *testSink) MaxRound(string) (uint64, bool, error) { return 0, false, nil }
+func (s *testSink) DeleteAfter(string, uint64) error      { return nil }
+func (s *testSink) Truncate(string) error                 { return nil }
+func (s *testSink) SetTTL(string, string) error           { return nil }
+func (s *testSink) Close() error                          { return nil }
+
+func (s *testSink) SendTotal(t *totalRow) error {
+	if s.fail || (s.failAt > 0 && len(s.rounds)+1 >= s.failAt) {
+		return errors.New("sink not available")
+	}
+	s.rounds = append(s.rounds, t.Round)
+	return nil
+}
+
+func testLogger() *logrus.Logger {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return log
+}
+
+// makeTestSpool returns exporter spooling into an empty spool file of a temp dir
+func makeTestSpool(t *testing.T, sink *testSink) *onlineExporter {
+	oe := &onlineExporter{log: testLogger(), sinks: []Sink{sink}}
+	sp, err := oe.MakeSpool(filepath.Join(t.TempDir(), "spool.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oe.spool = sp
+	return oe
+}
+
+func spooledRounds(sp *exportSpool) []uint64 {
+	var rounds []uint64
+	for _, e := range sp.entries {
+		rounds = append(rounds, e.Total.Round)
+	}
+	return rounds
+}
+
+func TestSpoolAppendReplayTrim(t *testing.T) {
+	tests := []struct {
+		name    string
+		failAt  int
+		sent    []uint64
+		pending []uint64
+	}{
+		{name: "all replayed", sent: []uint64{10, 20, 30}},
+		{name: "replay stops at failure", failAt: 3, sent: []uint64{10, 20}, pending: []uint64{30}},
+		{name: "nothing replayed", failAt: 1, pending: []uint64{10, 20, 30}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &testSink{fail: true}
+			oe := makeTestSpool(t, sink)
+			for _, rnd := range []uint64{10, 20, 30} {
+				if err := oe.export(&spoolEntry{Total: &totalRow{Round: rnd}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := spooledRounds(oe.spool); !slices.Equal(got, []uint64{10, 20, 30}) {
+				t.Fatalf("spooled %v", got)
+			}
+
+			sink.fail, sink.failAt = false, tt.failAt
+			if err := oe.replaySpool(true); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(sink.rounds, tt.sent) {
+				t.Errorf("sent %v, expected %v", sink.rounds, tt.sent)
+			}
+			if got := spooledRounds(oe.spool); !slices.Equal(got, tt.pending) {
+				t.Errorf("pending %v, expected %v", got, tt.pending)
+			}
+
+			// pending entries survive a restart
+			sp, err := oe.MakeSpool(oe.spool.fName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := spooledRounds(sp); !slices.Equal(got, tt.pending) {
+				t.Errorf("reloaded %v, expected %v", got, tt.pending)
+			}
+			if _, err := os.Stat(oe.spool.fName); len(tt.pending) == 0 && !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("empty spool file not removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestSpoolLoad(t *testing.T) {
+	const (
+		e10 = `{"spooled":1,"total":{"round":10}}`
+		e20 = `{"spooled":1,"total":{"round":20}}`
+	)
+	tests := []struct {
+		name    string
+		content string
+		rounds  []uint64
+		err     string
+	}{
+		{name: "clean", content: e10 + "\n" + e20 + "\n", rounds: []uint64{10, 20}},
+		{name: "empty lines", content: e10 + "\n\n" + e20 + "\n\n", rounds: []uint64{10, 20}},
+		{name: "torn last line", content: e10 + "\n" + e20 + "\n" + `{"spooled":1,"tot`, rounds: []uint64{10, 20}},
+		{name: "corrupted middle line", content: e10 + "\n" + `{"spooled":1,"tot` + "\n" + e20 + "\n", err: "corrupted spool"},
+		{name: "corrupted first line", content: "garbage\n" + e10 + "\n", err: "at line 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fName := filepath.Join(t.TempDir(), "spool.jsonl")
+			if err := os.WriteFile(fName, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			oe := &onlineExporter{log: testLogger()}
+			sp, err := oe.MakeSpool(fName)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := spooledRounds(sp); !slices.Equal(got, tt.rounds) {
+				t.Errorf("loaded %v, expected %v", got, tt.rounds)
+			}
+
+			// appended entry is readable after a torn line was dropped
+			if err := sp.append(&spoolEntry{Total: &totalRow{Round: 30}}); err != nil {
+				t.Fatal(err)
+			}
+			sp, err = oe.MakeSpool(fName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := spooledRounds(sp); !slices.Equal(got, append(tt.rounds, 30)) {
+				t.Errorf("reloaded %v, expected %v", got, append(tt.rounds, 30))
+			}
+		})
+	}
+}
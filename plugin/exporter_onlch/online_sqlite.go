@@ -0,0 +1,298 @@
+package exporter_onlch
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	_ "modernc.org/sqlite"
+)
+
+const sqliteHwmTab = "online_export_hwm"
+
+// sqliteAggregateDDL are columns of aggregate and tier tables
+const sqliteAggregateDDL = `addr TEXT NOT NULL, round INTEGER NOT NULL, ts INTEGER NOT NULL, rnds_online INTEGER NOT NULL,
+	sf_sum REAL NOT NULL, proposals INTEGER NOT NULL, payout_sum INTEGER NOT NULL, fees_collected INTEGER NOT NULL,
+	stake_sum REAL NOT NULL, payout_ratio REAL NOT NULL`
+
+// SQLiteSink exports rows to an embedded SQLite database
+// aggregate rollups are updated in the same transaction as the base aggregate rows
+type SQLiteSink struct {
+	sqlRows
+	db      *sql.DB
+	rollups []AggregateTier
+	cfg     *Config
+	ctx     context.Context
+	log     *logrus.Logger
+}
+
+// MakeSQLiteSink opens SQLite database and creates missing tables
+func (oe *onlineExporter) MakeSQLiteSink() (*SQLiteSink, error) {
+	if oe.cfg.SqliteFile == "" {
+		return nil, fmt.Errorf("sqlite sink requires sqlite-file")
+	}
+	for _, r := range oe.cfg.SqliteRollups {
+		if r.Bin <= 0 || r.Table == "" {
+			return nil, fmt.Errorf("sqlite rollup %q needs bin and table", r.Table)
+		}
+	}
+	fName := oe.cfg.SqliteFile
+	if !filepath.IsAbs(fName) {
+		fName = filepath.Join(oe.cfg.datadir, fName)
+	}
+	db, err := sql.Open("sqlite", "file:"+fName+"?_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// single writer, transactions are serialized by the export writer anyway
+	db.SetMaxOpenConns(1)
+	sq := &SQLiteSink{
+		db:      db,
+		rollups: oe.cfg.SqliteRollups,
+		cfg:     &oe.cfg,
+		ctx:     oe.ctx,
+		log:     oe.log,
+	}
+	sq.sqlRows = sqlRows{w: sq, cfg: &oe.cfg}
+	if err := sq.createTables(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sq, nil
+}
+
+// createTables creates high-water mark and configured tables if they do not exist
+func (sq *SQLiteSink) createTables() error {
+	tables := map[string]string{
+		sqliteHwmTab: "tbl TEXT PRIMARY KEY, round INTEGER NOT NULL",
+	}
+	if sq.cfg.AggTab != "" {
+		tables[sq.cfg.AggTab] = sqliteAggregateDDL + ", PRIMARY KEY (addr, round)"
+	}
+	for _, t := range sq.cfg.Tiers {
+		if t.Period != "" {
+			tables[t.Table] = sqliteAggregateDDL + ", first_round INTEGER NOT NULL, last_round INTEGER NOT NULL, rounds INTEGER NOT NULL, PRIMARY KEY (addr, round)"
+		} else {
+			tables[t.Table] = sqliteAggregateDDL + ", PRIMARY KEY (addr, round)"
+		}
+	}
+	for _, r := range sq.rollups {
+		tables[r.Table] = `addr TEXT NOT NULL, round INTEGER NOT NULL, ts INTEGER NOT NULL, rnds_online INTEGER NOT NULL,
+	sf_sum REAL NOT NULL, proposals INTEGER NOT NULL, payout_sum INTEGER NOT NULL, fees_collected INTEGER NOT NULL,
+	stake_sum REAL NOT NULL, PRIMARY KEY (addr, round)`
+	}
+	if sq.cfg.TotalTab != "" {
+		tables[sq.cfg.TotalTab] = `round INTEGER PRIMARY KEY, ts INTEGER NOT NULL, stake INTEGER NOT NULL, max_stake INTEGER NOT NULL,
+	stake_rwd INTEGER NOT NULL, onl INTEGER NOT NULL, onl_rwd INTEGER NOT NULL, drift INTEGER NOT NULL`
+	}
+	if sq.cfg.SnapshotTab != "" {
+		tables[sq.cfg.SnapshotTab] = "addr TEXT NOT NULL, round INTEGER NOT NULL, micro_algos INTEGER NOT NULL, stake_fraction REAL NOT NULL, PRIMARY KEY (addr, round)"
+	}
+	if sq.cfg.EventTab != "" {
+		tables[sq.cfg.EventTab] = `addr TEXT NOT NULL, round INTEGER NOT NULL, observed INTEGER NOT NULL, old_state TEXT NOT NULL,
+	new_state TEXT NOT NULL, reason TEXT NOT NULL, stake_before INTEGER NOT NULL, stake_after INTEGER NOT NULL`
+	}
+	if sq.cfg.KeyregTab != "" {
+		tables[sq.cfg.KeyregTab] = `round INTEGER NOT NULL, addr TEXT NOT NULL, vote_first INTEGER NOT NULL, vote_last INTEGER NOT NULL,
+	key_dilution INTEGER NOT NULL, vote_pk TEXT NOT NULL, selection_pk TEXT NOT NULL, state_proof_pk TEXT NOT NULL,
+	non_participation INTEGER NOT NULL, fee INTEGER NOT NULL, auth_addr TEXT NOT NULL, app_id INTEGER NOT NULL`
+	}
+	for table, columns := range tables {
+		if _, err := sq.db.ExecContext(sq.ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table, columns)); err != nil {
+			return fmt.Errorf("creating %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func (sq *SQLiteSink) Name() string {
+	return SinkSQLite
+}
+
+func (sq *SQLiteSink) Close() error {
+	return sq.db.Close()
+}
+
+// hwm returns the high-water mark of table in transaction tx
+func (sq *SQLiteSink) hwm(tx *sql.Tx, table string) (uint64, bool, error) {
+	var rnd int64
+	err := tx.QueryRowContext(sq.ctx, "SELECT round FROM "+sqliteHwmTab+" WHERE tbl = ?", table).Scan(&rnd)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return uint64(rnd), true, nil
+}
+
+// insert inserts chunks newer than the high-water mark into table and moves the mark in one transaction
+// rollups of the aggregate table are updated in the same transaction
+func (sq *SQLiteSink) insert(table string, columns []string, chunks []sqlChunk) error {
+	tx, err := sq.db.BeginTx(sq.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	hwm, exists, err := sq.hwm(tx, table)
+	if err != nil {
+		return err
+	}
+	fresh, last := freshChunks(sq.log, table, chunks, hwm, exists)
+	if len(fresh) == 0 {
+		return nil
+	}
+	stmt, err := tx.PrepareContext(sq.ctx, fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		table, strings.Join(columns, ","), strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",")))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, c := range fresh {
+		for _, row := range c.rows {
+			if _, err := stmt.ExecContext(sq.ctx, row...); err != nil {
+				return err
+			}
+		}
+	}
+	if table == sq.cfg.AggTab {
+		if err := sq.rollup(tx, fresh); err != nil {
+			return err
+		}
+	}
+	upsert := "INSERT INTO " + sqliteHwmTab + " (tbl, round) VALUES (?, ?) ON CONFLICT (tbl) DO UPDATE SET round = excluded.round"
+	if _, err := tx.ExecContext(sq.ctx, upsert, table, int64(last)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// timestamp returns ts as unix seconds
+func (sq *SQLiteSink) timestamp(ts int64) any {
+	return ts
+}
+
+// rollup adds base aggregate rows to rollup tables, rollup bins are aligned on the base bin round
+func (sq *SQLiteSink) rollup(tx *sql.Tx, chunks []sqlChunk) error {
+	for _, r := range sq.rollups {
+		stmt, err := tx.PrepareContext(sq.ctx, fmt.Sprintf(`INSERT INTO %s (addr, round, ts, rnds_online, sf_sum, proposals, payout_sum, fees_collected, stake_sum)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (addr, round) DO UPDATE SET
+		ts = min(ts, excluded.ts),
+		rnds_online = rnds_online + excluded.rnds_online,
+		sf_sum = sf_sum + excluded.sf_sum,
+		proposals = proposals + excluded.proposals,
+		payout_sum = payout_sum + excluded.payout_sum,
+		fees_collected = fees_collected + excluded.fees_collected,
+		stake_sum = stake_sum + excluded.stake_sum`, r.Table))
+		if err != nil {
+			return err
+		}
+		for _, c := range chunks {
+			bin := int64(c.round) / r.Bin * r.Bin
+			for _, row := range c.rows {
+				// base row columns without payout_ratio, round moved to the rollup bin
+				if _, err := stmt.ExecContext(sq.ctx, row[0], bin, row[2], row[3], row[4], row[5], row[6], row[7], row[8]); err != nil {
+					stmt.Close()
+					return err
+				}
+			}
+		}
+		stmt.Close()
+	}
+	return nil
+}
+
+// rebuildRollups recomputes rollup bins from base aggregate rows after round
+func (sq *SQLiteSink) rebuildRollups(tx *sql.Tx, rnd uint64) error {
+	for _, r := range sq.rollups {
+		start := int64(rnd+1) / r.Bin * r.Bin
+		if _, err := tx.ExecContext(sq.ctx, fmt.Sprintf("DELETE FROM %s WHERE round >= ?", r.Table), start); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(sq.ctx, fmt.Sprintf(`INSERT INTO %s (addr, round, ts, rnds_online, sf_sum, proposals, payout_sum, fees_collected, stake_sum)
+	SELECT addr, round / ? * ?, min(ts), sum(rnds_online), sum(sf_sum), sum(proposals), sum(payout_sum), sum(fees_collected), sum(stake_sum)
+	FROM %s WHERE round >= ? GROUP BY addr, round / ?`, r.Table, sq.cfg.AggTab), r.Bin, r.Bin, start, r.Bin)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MaxRound returns the high-water mark of table
+func (sq *SQLiteSink) MaxRound(table string) (uint64, bool, error) {
+	var rnd int64
+	err := sq.db.QueryRowContext(sq.ctx, "SELECT round FROM "+sqliteHwmTab+" WHERE tbl = ?", table).Scan(&rnd)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return uint64(rnd), true, nil
+}
+
+// DeleteAfter deletes rows after round from table, rebuilds affected rollup bins and moves the high-water mark back
+func (sq *SQLiteSink) DeleteAfter(table string, rnd uint64) error {
+	sq.log.Warnf("Deleting rows after round %d from %s", rnd, table)
+	tx, err := sq.db.BeginTx(sq.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(sq.ctx, fmt.Sprintf("DELETE FROM %s WHERE round > ?", table), int64(rnd)); err != nil {
+		return err
+	}
+	if table == sq.cfg.AggTab {
+		if err := sq.rebuildRollups(tx, rnd); err != nil {
+			return err
+		}
+	}
+	var last sql.NullInt64
+	if err := tx.QueryRowContext(sq.ctx, fmt.Sprintf("SELECT max(round) FROM %s", table)).Scan(&last); err != nil {
+		return err
+	}
+	if !last.Valid {
+		_, err = tx.ExecContext(sq.ctx, "DELETE FROM "+sqliteHwmTab+" WHERE tbl = ?", table)
+	} else {
+		_, err = tx.ExecContext(sq.ctx, "UPDATE "+sqliteHwmTab+" SET round = ? WHERE tbl = ?", last.Int64, table)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Truncate deletes all rows from table, its rollups and its high-water mark
+func (sq *SQLiteSink) Truncate(table string) error {
+	tx, err := sq.db.BeginTx(sq.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	tables := []string{table}
+	if table == sq.cfg.AggTab {
+		for _, r := range sq.rollups {
+			tables = append(tables, r.Table)
+		}
+	}
+	for _, t := range tables {
+		if _, err := tx.ExecContext(sq.ctx, "DELETE FROM "+t); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(sq.ctx, "DELETE FROM "+sqliteHwmTab+" WHERE tbl = ?", table); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetTTL is not supported by SQLite
+func (sq *SQLiteSink) SetTTL(table string, ttl string) error {
+	sq.log.Warnf("Ignoring TTL of %s in SQLite", table)
+	return nil
+}
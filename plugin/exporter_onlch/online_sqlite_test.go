@@ -0,0 +1,133 @@
+package exporter_onlch
+
+import (
+	"context"
+	"testing"
+)
+
+// makeTestSQLite returns SQLite sink with aggregate, total and rollup tables in a temp data dir
+func makeTestSQLite(t *testing.T) *SQLiteSink {
+	oe := &onlineExporter{log: testLogger(), ctx: context.Background()}
+	oe.cfg.datadir = t.TempDir()
+	oe.cfg.SqliteFile = "online.db"
+	oe.cfg.AggTab = "online_stake_ag"
+	oe.cfg.TotalTab = "online_total"
+	oe.cfg.SqliteRollups = []AggregateTier{{Bin: 1000, Table: "online_stake_ag1k"}}
+	sq, err := oe.MakeSQLiteSink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sq.Close() })
+	return sq
+}
+
+func testBin(rnd uint64, online int32) *aggregateBin {
+	return &aggregateBin{
+		Round: rnd,
+		Ts:    int64(rnd),
+		Rows:  []aggregateRow{{Addr: "A", RndsOnline: online, StakeSum: float64(online)}},
+	}
+}
+
+// sqliteInt returns a single integer query result
+func sqliteInt(t *testing.T, sq *SQLiteSink, query string) int64 {
+	var v int64
+	if err := sq.db.QueryRow(query).Scan(&v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestSQLiteSkipsCommittedRows(t *testing.T) {
+	tests := []struct {
+		name     string
+		replay   []*aggregateBin
+		rows     int64
+		online   int64
+		hwmRound uint64
+	}{
+		{name: "same bins", replay: []*aggregateBin{testBin(500, 10), testBin(1000, 20)}, rows: 2, online: 30, hwmRound: 1000},
+		{name: "older bin", replay: []*aggregateBin{testBin(500, 10)}, rows: 2, online: 30, hwmRound: 1000},
+		{name: "committed and new bins", replay: []*aggregateBin{testBin(1000, 20), testBin(1500, 5)}, rows: 3, online: 35, hwmRound: 1500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sq := makeTestSQLite(t)
+			if err := sq.SendAggregates([]*aggregateBin{testBin(500, 10), testBin(1000, 20)}); err != nil {
+				t.Fatal(err)
+			}
+			if err := sq.SendAggregates(tt.replay); err != nil {
+				t.Fatal(err)
+			}
+			if rows := sqliteInt(t, sq, "SELECT count(*) FROM online_stake_ag"); rows != tt.rows {
+				t.Errorf("%d rows, expected %d", rows, tt.rows)
+			}
+			// replayed rows are not added to rollups again
+			if online := sqliteInt(t, sq, "SELECT sum(rnds_online) FROM online_stake_ag1k"); online != tt.online {
+				t.Errorf("rollup rounds online %d, expected %d", online, tt.online)
+			}
+			rnd, exists, err := sq.MaxRound(sq.cfg.AggTab)
+			if err != nil || !exists || rnd != tt.hwmRound {
+				t.Errorf("high-water mark %d %t %v, expected %d", rnd, exists, err, tt.hwmRound)
+			}
+		})
+	}
+}
+
+func TestSQLiteSkipsCommittedTotal(t *testing.T) {
+	sq := makeTestSQLite(t)
+	for _, rnd := range []uint64{10, 20, 10, 20} {
+		if err := sq.SendTotal(&totalRow{Round: rnd}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rows := sqliteInt(t, sq, "SELECT count(*) FROM online_total"); rows != 2 {
+		t.Errorf("%d rows, expected 2", rows)
+	}
+}
+
+func TestSQLiteDeleteAfterRebuildsRollups(t *testing.T) {
+	tests := []struct {
+		name     string
+		after    uint64
+		rollups  int64
+		online   int64
+		hwmRound uint64
+		hwm      bool
+	}{
+		{name: "partial rollup bin", after: 1000, rollups: 2, online: 30, hwmRound: 1000, hwm: true},
+		{name: "whole rollup bin", after: 999, rollups: 1, online: 10, hwmRound: 500, hwm: true},
+		{name: "nothing deleted", after: 2000, rollups: 2, online: 35, hwmRound: 1500, hwm: true},
+		{name: "everything deleted", after: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sq := makeTestSQLite(t)
+			bins := []*aggregateBin{testBin(500, 10), testBin(1000, 20), testBin(1500, 5)}
+			if err := sq.SendAggregates(bins); err != nil {
+				t.Fatal(err)
+			}
+			if err := sq.DeleteAfter(sq.cfg.AggTab, tt.after); err != nil {
+				t.Fatal(err)
+			}
+			if rows := sqliteInt(t, sq, "SELECT count(*) FROM online_stake_ag1k"); rows != tt.rollups {
+				t.Errorf("%d rollup rows, expected %d", rows, tt.rollups)
+			}
+			if online := sqliteInt(t, sq, "SELECT coalesce(sum(rnds_online), 0) FROM online_stake_ag1k"); online != tt.online {
+				t.Errorf("rollup rounds online %d, expected %d", online, tt.online)
+			}
+			rnd, exists, err := sq.MaxRound(sq.cfg.AggTab)
+			if err != nil || exists != tt.hwm || rnd != tt.hwmRound {
+				t.Errorf("high-water mark %d %t %v, expected %d %t", rnd, exists, err, tt.hwmRound, tt.hwm)
+			}
+
+			// deleted bins are exported again
+			if err := sq.SendAggregates(bins); err != nil {
+				t.Fatal(err)
+			}
+			if online := sqliteInt(t, sq, "SELECT sum(rnds_online) FROM online_stake_ag1k"); online != 35 {
+				t.Errorf("rollup rounds online %d after re-export, expected 35", online)
+			}
+		})
+	}
+}
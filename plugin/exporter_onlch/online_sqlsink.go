@@ -0,0 +1,133 @@
+package exporter_onlch
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// column names of SQL sink tables
+var (
+	sqlAggregateColumns = []string{"addr", "round", "ts", "rnds_online", "sf_sum", "proposals", "payout_sum", "fees_collected", "stake_sum", "payout_ratio"}
+	sqlPeriodColumns    = []string{"first_round", "last_round", "rounds"}
+	sqlTotalColumns     = []string{"round", "ts", "stake", "max_stake", "stake_rwd", "onl", "onl_rwd", "drift"}
+	sqlSnapshotColumns  = []string{"addr", "round", "micro_algos", "stake_fraction"}
+	sqlEventColumns     = []string{"addr", "round", "observed", "old_state", "new_state", "reason", "stake_before", "stake_after"}
+	sqlKeyregColumns    = []string{"round", "addr", "vote_first", "vote_last", "key_dilution", "vote_pk", "selection_pk", "state_proof_pk", "non_participation", "fee", "auth_addr", "app_id"}
+)
+
+// sqlChunk is a group of rows committed with the same high-water mark round
+type sqlChunk struct {
+	round uint64
+	rows  [][]any
+}
+
+// sqlWriter is the dialect specific part of a SQL sink
+// rows of a table are written in a transaction that also moves the table high-water mark
+type sqlWriter interface {
+	insert(table string, columns []string, chunks []sqlChunk) error
+	// timestamp converts unix seconds to the ts column value
+	timestamp(ts int64) any
+}
+
+// sqlRows builds rows of SQL sink tables and hands them to the dialect writer
+type sqlRows struct {
+	w   sqlWriter
+	cfg *Config
+}
+
+// freshChunks returns chunks above the high-water mark and the highest of their rounds
+// chunks at or below the mark were committed before and are skipped on replay
+func freshChunks(log *logrus.Logger, table string, chunks []sqlChunk, hwm uint64, exists bool) ([]sqlChunk, uint64) {
+	var (
+		fresh []sqlChunk
+		last  uint64
+	)
+	for _, c := range chunks {
+		if exists && c.round <= hwm {
+			log.WithFields(logrus.Fields{"round": c.round}).Debugf("Skipping %s rows committed before (%d)", table, hwm)
+			continue
+		}
+		fresh = append(fresh, c)
+		last = max(last, c.round)
+	}
+	return fresh, last
+}
+
+// SendAggregates inserts aggregate bins, one transaction per run of bins of the same table
+func (sr *sqlRows) SendAggregates(bins []*aggregateBin) error {
+	for len(bins) > 0 {
+		n := 1
+		for n < len(bins) && sr.cfg.binTable(bins[n]) == sr.cfg.binTable(bins[0]) {
+			n++
+		}
+		columns := sqlAggregateColumns
+		// wall clock tiers record the processed round range of the period
+		if bins[0].Period != nil {
+			columns = append(append([]string{}, sqlAggregateColumns...), sqlPeriodColumns...)
+		}
+		chunks := make([]sqlChunk, 0, n)
+		for _, bin := range bins[:n] {
+			c := sqlChunk{round: bin.Round, rows: make([][]any, 0, len(bin.Rows))}
+			ts := sr.w.timestamp(bin.Ts)
+			for _, r := range bin.Rows {
+				row := []any{r.Addr, int64(bin.Round), ts, r.RndsOnline, r.SFSum, r.Proposals, int64(r.PayoutSum), int64(r.Fees), r.StakeSum, r.PayoutRatio}
+				if bin.Period != nil {
+					row = append(row, int64(bin.Period.First), int64(bin.Period.Last), bin.Period.Rounds)
+				}
+				c.rows = append(c.rows, row)
+			}
+			chunks = append(chunks, c)
+		}
+		if err := sr.w.insert(sr.cfg.binTable(bins[0]), columns, chunks); err != nil {
+			return err
+		}
+		bins = bins[n:]
+	}
+	return nil
+}
+
+// SendTotal inserts total row
+func (sr *sqlRows) SendTotal(t *totalRow) error {
+	row := []any{int64(t.Round), sr.w.timestamp(t.Ts), t.Stake, t.MaxStake, t.StakeRwd, t.Onl, t.OnlRwd, t.Drift}
+	return sr.w.insert(sr.cfg.TotalTab, sqlTotalColumns, []sqlChunk{{round: t.Round, rows: [][]any{row}}})
+}
+
+// SendSnapshot inserts snapshot rows
+func (sr *sqlRows) SendSnapshot(rows []snapshotRow) error {
+	c := sqlChunk{round: rows[0].Round, rows: make([][]any, 0, len(rows))}
+	for _, r := range rows {
+		c.rows = append(c.rows, []any{r.Addr, int64(r.Round), r.Stake, r.SF})
+	}
+	return sr.w.insert(sr.cfg.SnapshotTab, sqlSnapshotColumns, []sqlChunk{c})
+}
+
+// SendEvents inserts event rows, the high-water mark is the highest effective round
+func (sr *sqlRows) SendEvents(rows []eventRow) error {
+	c := sqlChunk{rows: make([][]any, 0, len(rows))}
+	for _, r := range rows {
+		c.round = max(c.round, r.Round)
+		c.rows = append(c.rows, []any{r.Addr, int64(r.Round), int64(r.Observed), r.OldState, r.NewState, r.Reason, r.StakeBefore, r.StakeAfter})
+	}
+	return sr.w.insert(sr.cfg.EventTab, sqlEventColumns, []sqlChunk{c})
+}
+
+// SendKeyregs inserts keyreg rows
+func (sr *sqlRows) SendKeyregs(rows []keyregRow) error {
+	c := sqlChunk{round: rows[0].Round, rows: make([][]any, 0, len(rows))}
+	for _, r := range rows {
+		c.rows = append(c.rows, []any{
+			int64(r.Round),
+			r.Addr,
+			int64(r.VoteFirst),
+			int64(r.VoteLast),
+			int64(r.KeyDilution),
+			r.VotePK,
+			r.SelectionPK,
+			r.StateProofPK,
+			r.NonParticipation,
+			int64(r.Fee),
+			r.AuthAddr,
+			int64(r.AppID),
+		})
+	}
+	return sr.w.insert(sr.cfg.KeyregTab, sqlKeyregColumns, []sqlChunk{c})
+}
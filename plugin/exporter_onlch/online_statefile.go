@@ -0,0 +1,122 @@
+package exporter_onlch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/algorand/go-algorand-sdk/v2/types"
+)
+
+// errLegacyState is returned with the raw content of state files written before headers were added
+var errLegacyState = errors.New("state file has no header")
+
+// stateFile is the persisted state envelope
+// header fields are verified before the state payload is trusted
+type stateFile struct {
+	Round    types.Round     `json:"round"`
+	Genesis  string          `json:"genesis"`
+	Checksum string          `json:"checksum"`
+	State    json.RawMessage `json:"state"`
+}
+
+// stateChecksum hashes compacted payload as the envelope re-indents embedded state
+func stateChecksum(payload []byte) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, payload); err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// writeStateFile atomically replaces fName with state payload
+func writeStateFile(fName string, round types.Round, gh types.Digest, payload []byte) error {
+	sf := stateFile{
+		Round:    round,
+		Genesis:  base64.StdEncoding.EncodeToString(gh[:]),
+		Checksum: stateChecksum(payload),
+		State:    payload,
+	}
+	content, err := json.MarshalIndent(sf, "", " ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fName, content)
+}
+
+// writeFileAtomic replaces fName with content
+// content is written to a temp file in the same directory, synced and renamed
+func writeFileAtomic(fName string, content []byte) error {
+	dir := filepath.Dir(fName)
+	tmp, err := os.CreateTemp(dir, filepath.Base(fName)+".tmp*")
+	if err != nil {
+		return err
+	}
+	// no-op after a successful rename
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), fName); err != nil {
+		return err
+	}
+	// persist the rename itself
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// loadStateFile reads state file envelope and verifies its checksum
+// content of files without header is returned as state with errLegacyState
+func loadStateFile(fName string) (*stateFile, error) {
+	content, err := os.ReadFile(fName)
+	if err != nil {
+		return nil, err
+	}
+	var sf stateFile
+	if err := json.Unmarshal(content, &sf); err != nil {
+		return nil, fmt.Errorf("corrupted state file %s: %w", fName, err)
+	}
+	if len(sf.State) == 0 {
+		return &stateFile{State: content}, errLegacyState
+	}
+	if sf.Checksum != stateChecksum(sf.State) {
+		return nil, fmt.Errorf("state file %s checksum mismatch", fName)
+	}
+	return &sf, nil
+}
+
+// readStateFile reads and verifies state file, returns state payload and its round
+func readStateFile(fName string, gh types.Digest) ([]byte, types.Round, error) {
+	sf, err := loadStateFile(fName)
+	if errors.Is(err, errLegacyState) {
+		return sf.State, 0, err
+	} else if err != nil {
+		return nil, 0, err
+	}
+	if genesis := base64.StdEncoding.EncodeToString(gh[:]); sf.Genesis != genesis {
+		return nil, 0, fmt.Errorf("state file %s genesis hash %s does not match %s", fName, sf.Genesis, genesis)
+	}
+	return sf.State, sf.Round, nil
+}
@@ -0,0 +1,124 @@
+package exporter_onlch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/algorand/go-algorand-sdk/v2/types"
+)
+
+func TestStateFile(t *testing.T) {
+	gh := types.Digest{1, 2, 3}
+	payload := []byte(`{"updated":42,"processed":42}`)
+
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, fName string)
+		gh      types.Digest
+		state   string
+		round   types.Round
+		err     string
+		legacy  bool
+	}{
+		{
+			name:  "roundtrip",
+			gh:    gh,
+			state: string(payload),
+			round: 42,
+		},
+		{
+			name: "bad checksum",
+			prepare: func(t *testing.T, fName string) {
+				content, err := os.ReadFile(fName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				content = []byte(strings.Replace(string(content), `"updated": 42`, `"updated": 43`, 1))
+				if err := os.WriteFile(fName, content, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			gh:  gh,
+			err: "checksum mismatch",
+		},
+		{
+			name: "genesis mismatch",
+			gh:   types.Digest{9},
+			err:  "genesis hash",
+		},
+		{
+			name: "legacy file without header",
+			prepare: func(t *testing.T, fName string) {
+				if err := os.WriteFile(fName, payload, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			gh:     gh,
+			state:  string(payload),
+			legacy: true,
+		},
+		{
+			name: "torn temp file",
+			prepare: func(t *testing.T, fName string) {
+				// crash before rename leaves the previous state in place
+				if err := os.WriteFile(fName+".tmp123", []byte(`{"round": 43, "gen`), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			gh:    gh,
+			state: string(payload),
+			round: 42,
+		},
+		{
+			name: "torn state file",
+			prepare: func(t *testing.T, fName string) {
+				if err := os.WriteFile(fName, []byte(`{"round": 42, "gen`), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			gh:  gh,
+			err: "corrupted state file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fName := filepath.Join(t.TempDir(), "state.json")
+			if err := writeStateFile(fName, 42, gh, payload); err != nil {
+				t.Fatal(err)
+			}
+			if tt.prepare != nil {
+				tt.prepare(t, fName)
+			}
+			state, round, err := readStateFile(fName, tt.gh)
+			switch {
+			case tt.legacy:
+				if !errors.Is(err, errLegacyState) {
+					t.Fatalf("expected legacy state, got %v", err)
+				}
+			case tt.err != "":
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			case err != nil:
+				t.Fatal(err)
+			}
+			// the envelope re-indents embedded state
+			var buf bytes.Buffer
+			if err := json.Compact(&buf, state); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.state {
+				t.Errorf("state %s, expected %s", buf.String(), tt.state)
+			}
+			if round != tt.round {
+				t.Errorf("round %d, expected %d", round, tt.round)
+			}
+		})
+	}
+}
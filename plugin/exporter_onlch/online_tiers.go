@@ -0,0 +1,256 @@
+package exporter_onlch
+
+import (
+	"fmt"
+
+	"github.com/algorand/go-algorand-sdk/v2/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	PeriodHour = "hour"
+	PeriodDay  = "day"
+)
+
+// tierSpec is the bin size of a tier in rounds or a wall clock period in seconds
+type tierSpec struct {
+	bin    int64
+	period int64
+}
+
+// periodBin is the open bin of a wall clock tier
+// rounds are processed (not lag shifted) rounds with block timestamps in the period
+type periodBin struct {
+	Start  int64  `json:"start"`
+	First  uint64 `json:"first"`
+	Last   uint64 `json:"last"`
+	Rounds int32  `json:"rounds"`
+}
+
+// aggAccum is an aggregate accumulator of an account in a single tier
+type aggAccum struct {
+	SFSum     float64          `json:"sfsum,omitempty"`
+	Online    int32            `json:"onlrnd,omitempty"`
+	StakeSum  float64          `json:"stakesum,omitempty"`
+	Proposals int32            `json:"prop,omitempty"`
+	Payout    types.MicroAlgos `json:"payout,omitempty"`
+	Fees      types.MicroAlgos `json:"fees,omitempty"`
+}
+
+func (a *aggAccum) isEmpty() bool {
+	return a.Online == 0 && a.Proposals == 0 && a.Payout == 0 && a.Fees == 0
+}
+
+// payoutRatio returns payout to average stake ratio of the accumulator
+func (a *aggAccum) payoutRatio() float64 {
+	if a.Online == 0 || a.StakeSum == 0 {
+		return 0
+	}
+	return float64(a.Payout) / (a.StakeSum / float64(a.Online))
+}
+
+// tierAccums returns tier accumulators of the account sized to configured tiers
+func (onls *onlineStakeState) tierAccums(acc *partAccount) []aggAccum {
+	switch {
+	case len(acc.Tiers) < len(onls.tiers):
+		acc.Tiers = append(acc.Tiers, make([]aggAccum, len(onls.tiers)-len(acc.Tiers))...)
+	case len(acc.Tiers) > len(onls.tiers):
+		acc.Tiers = acc.Tiers[:len(onls.tiers)]
+	}
+	return acc.Tiers
+}
+
+// aggEmpty returns true if account has nothing accumulated in any tier
+func (onls *onlineStakeState) aggEmpty(acc *partAccount) bool {
+	if acc.AggOnline != 0 || acc.AggProposals != 0 || acc.AggPayout != 0 || acc.AggFees != 0 {
+		return false
+	}
+	for i := range acc.Tiers {
+		if !acc.Tiers[i].isEmpty() {
+			return false
+		}
+	}
+	return true
+}
+
+// setTiers configures tiers and sizes open period bins of persisted state
+func (onls *onlineStakeState) setTiers(tiers []tierSpec) {
+	onls.tiers = tiers
+	switch {
+	case len(onls.Periods) < len(tiers):
+		onls.Periods = append(onls.Periods, make([]periodBin, len(tiers)-len(onls.Periods))...)
+	case len(onls.Periods) > len(tiers):
+		onls.Periods = onls.Periods[:len(tiers)]
+	}
+}
+
+// updateTiers updates tier accumulators with lag shifted round lRound
+// round tier bins are aligned on lag shifted rounds, returns indexes of full round tiers
+// wall clock tiers skip genesis rounds (ts 0)
+func (onls *onlineStakeState) updateTiers(lRound uint64, round types.Round, ts int64) []int {
+	if len(onls.tiers) == 0 {
+		return nil
+	}
+	for i, t := range onls.tiers {
+		if t.period == 0 || ts == 0 {
+			continue
+		}
+		p := &onls.Periods[i]
+		if p.Rounds == 0 {
+			p.Start = ts - ts%t.period
+			p.First = uint64(round)
+		}
+		p.Last = uint64(round)
+		p.Rounds++
+	}
+	for _, acc := range onls.Accounts {
+		if acc.Stake > 0 && acc.isVoting(round) {
+			for i := range onls.tierAccums(acc) {
+				if onls.tiers[i].period > 0 && ts == 0 {
+					continue
+				}
+				acc.Tiers[i].Online++
+				acc.Tiers[i].SFSum += acc.stakeFraction
+				acc.Tiers[i].StakeSum += float64(acc.votingStake)
+			}
+		}
+	}
+	var full []int
+	for i, t := range onls.tiers {
+		if t.bin > 0 && lRound%uint64(t.bin) == uint64(t.bin)-1 {
+			full = append(full, i)
+		}
+	}
+	return full
+}
+
+// closedPeriods returns indexes of wall clock tiers whose open bin ends before block timestamp ts
+func (onls *onlineStakeState) closedPeriods(ts int64) []int {
+	var closed []int
+	for i, t := range onls.tiers {
+		if t.period > 0 && onls.Periods[i].Rounds > 0 && ts-ts%t.period != onls.Periods[i].Start {
+			closed = append(closed, i)
+		}
+	}
+	return closed
+}
+
+// tierBinRound returns the first lag shifted round of tier bin containing lag shifted round lRound
+func (onls *onlineStakeState) tierBinRound(tier int, lRound uint64) uint64 {
+	if onls.tiers[tier].period > 0 {
+		return onls.Periods[tier].First + onls.lag()
+	}
+	return lRound - lRound%uint64(onls.tiers[tier].bin)
+}
+
+// resetTier resets tier accumulators and removes accounts marked for deletion with nothing left to export
+func (onls *onlineStakeState) resetTier(tier int, round types.Round) {
+	onls.Periods[tier] = periodBin{}
+	for addr, acct := range onls.Accounts {
+		if tier < len(acct.Tiers) {
+			acct.Tiers[tier] = aggAccum{}
+		}
+		if acct.state != Online && onls.aggEmpty(acct) {
+			onls.log.WithFields(logrus.Fields{"round": round, "addr": acct.Addr}).Infof("Deleting account : %s", acct.state.String())
+			delete(onls.Accounts, addr)
+		}
+	}
+}
+
+// validateTiers checks configured aggregate tiers
+func (oe *onlineExporter) validateTiers() error {
+	for _, t := range oe.cfg.Tiers {
+		if t.Table == "" {
+			return fmt.Errorf("aggregate tier with bin %d has no table", t.Bin)
+		}
+		switch t.Period {
+		case "":
+			if t.Bin <= 0 {
+				return fmt.Errorf("aggregate tier %q has no bin or period", t.Table)
+			}
+		case PeriodHour, PeriodDay:
+			if t.Bin > 0 {
+				return fmt.Errorf("aggregate tier %q has both bin and period", t.Table)
+			}
+		default:
+			return fmt.Errorf("aggregate tier %q has unknown period %q", t.Table, t.Period)
+		}
+	}
+	return nil
+}
+
+// tierSpecs returns configured tiers
+func (oe *onlineExporter) tierSpecs() []tierSpec {
+	var tiers []tierSpec
+	for _, t := range oe.cfg.Tiers {
+		switch t.Period {
+		case PeriodHour:
+			tiers = append(tiers, tierSpec{period: 3600})
+		case PeriodDay:
+			tiers = append(tiers, tierSpec{period: 86400})
+		default:
+			tiers = append(tiers, tierSpec{bin: t.Bin})
+		}
+	}
+	return tiers
+}
+
+// exportTier exports tier aggregate to its table
+func (oe *onlineExporter) exportTier(tier int, rnd uint64, ts int64) error {
+	if oe.isDebugRun() {
+		//skip exporting aggregates
+		return nil
+	}
+	bin := &aggregateBin{
+		Table: oe.cfg.Tiers[tier].Table,
+		Round: rnd,
+		Ts:    ts,
+		Rows:  make([]aggregateRow, 0, len(oe.onls.Accounts)),
+	}
+	if oe.onls.tiers[tier].period > 0 {
+		p := oe.onls.Periods[tier]
+		bin.Ts = p.Start
+		bin.Period = &p
+	}
+	for _, acc := range oe.onls.sortedAccounts() {
+		a := &oe.onls.tierAccums(acc)[tier]
+		if acc.state != Online && a.isEmpty() {
+			continue
+		}
+		bin.Rows = append(bin.Rows, aggregateRow{
+			Addr:        acc.Addr,
+			RndsOnline:  a.Online,
+			SFSum:       a.SFSum,
+			Proposals:   a.Proposals,
+			PayoutSum:   uint64(a.Payout),
+			Fees:        uint64(a.Fees),
+			StakeSum:    a.StakeSum,
+			PayoutRatio: a.payoutRatio(),
+		})
+	}
+	oe.batcher.Add(bin)
+	return nil
+}
+
+// exportTiers exports and resets full tiers
+func (oe *onlineExporter) exportTiers(full []int, lRound uint64, round types.Round, ts int64) error {
+	for _, i := range full {
+		if err := oe.exportTier(i, oe.onls.tierBinRound(i, lRound), ts); err != nil {
+			return err
+		}
+		oe.onls.resetTier(i, round)
+	}
+	return nil
+}
+
+// exportPeriods exports and resets wall clock tiers closed by block timestamp ts
+// must run before the round is accumulated
+func (oe *onlineExporter) exportPeriods(round types.Round, ts int64) error {
+	for _, i := range oe.onls.closedPeriods(ts) {
+		if err := oe.exportTier(i, oe.onls.tierBinRound(i, 0), ts); err != nil {
+			return err
+		}
+		oe.onls.resetTier(i, round)
+	}
+	return nil
+}
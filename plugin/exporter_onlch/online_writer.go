@@ -0,0 +1,127 @@
+package exporter_onlch
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// writerJob is either an export entry or a state file update
+// state updates are queued behind exports so state never gets ahead of exported bins
+type writerJob struct {
+	entry   *spoolEntry
+	key     string
+	persist func() error
+}
+
+// exportWriter delivers queued jobs in order on a background goroutine
+type exportWriter struct {
+	queue chan *writerJob
+	done  chan struct{}
+	mu    sync.Mutex
+	err   error
+	log   *logrus.Logger
+}
+
+// MakeWriter starts the background writer with queue of size jobs
+func (oe *onlineExporter) MakeWriter(size int) *exportWriter {
+	w := &exportWriter{
+		queue: make(chan *writerJob, size),
+		done:  make(chan struct{}),
+		log:   oe.log,
+	}
+	go oe.runWriter(w)
+	return w
+}
+
+// runWriter executes jobs until the queue is closed or a job fails
+// spooled exports are replayed between jobs
+func (oe *onlineExporter) runWriter(w *exportWriter) {
+	defer close(w.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case job, ok := <-w.queue:
+			if !ok {
+				return
+			}
+			exportQueueDepth.Set(float64(len(w.queue)))
+			if err := oe.runJob(job); err != nil {
+				w.fail(err)
+				return
+			}
+		case <-ticker.C:
+			if err := oe.replaySpool(false); err != nil {
+				w.fail(err)
+				return
+			}
+		}
+	}
+}
+
+// runJob exports entry or writes state
+func (oe *onlineExporter) runJob(job *writerJob) error {
+	if job.entry != nil {
+		return oe.export(job.entry)
+	}
+	return job.persist()
+}
+
+func (w *exportWriter) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.log.Errorf("Export writer stopped: %v", err)
+	w.err = err
+}
+
+// Err returns the error that stopped the writer
+func (w *exportWriter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Submit queues job, blocks while the queue is full
+func (w *exportWriter) Submit(job *writerJob) error {
+	if err := w.Err(); err != nil {
+		return err
+	}
+	select {
+	case w.queue <- job:
+		exportQueueDepth.Set(float64(len(w.queue)))
+		return nil
+	default:
+	}
+	w.log.Warnf("Export queue full (%d), waiting for writer", cap(w.queue))
+	start := time.Now()
+	select {
+	case w.queue <- job:
+		w.log.Infof("Export queue blocked for %s", time.Since(start).Truncate(time.Millisecond))
+		return nil
+	case <-w.done:
+		return w.Err()
+	}
+}
+
+// Close drains the queue and waits for the writer to finish
+func (w *exportWriter) Close() error {
+	close(w.queue)
+	<-w.done
+	exportQueueDepth.Set(0)
+	return w.Err()
+}
+
+// submit queues job for the writer or runs it directly before the writer is started
+func (oe *onlineExporter) submit(job *writerJob) error {
+	if oe.writer == nil {
+		return oe.runJob(job)
+	}
+	return oe.writer.Submit(job)
+}
+
+// enqueue queues export entry for the writer
+func (oe *onlineExporter) enqueue(e *spoolEntry) error {
+	return oe.submit(&writerJob{entry: e})
+}